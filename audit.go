@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var (
+	audit                *auditLog // nil unless -auditfile is used
+	auditContainerRegexp *regexp.Regexp
+	unauditedPaths       = map[string]bool{"/healthz": true, "/readyz": true}
+)
+
+func init() {
+	var err error
+	// Matches the same paths as the container handlers, including a trailing slash
+	auditContainerRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)(/[a-z]+)?/?$`)
+	if err != nil {
+		panic(fmt.Sprintf("Audit container regex error : %s", err))
+	}
+}
+
+// auditEntry records who did what from where, Time is when the request started
+type auditEntry struct {
+	Time          time.Time
+	User          string // Empty if authentication is disabled
+	AuthMethod    string `json:",omitempty"`
+	RemoteAddr    string
+	ForwardedFor  string `json:",omitempty"`
+	Method        string
+	Path          string
+	Query         string `json:",omitempty"`
+	Action        string
+	Container     string `json:",omitempty"` // As given in the url, so a name, id prefix or full id
+	ContainerID   string `json:",omitempty"` // What the container was resolved to, empty if it was not found
+	ContainerName string `json:",omitempty"`
+	Status        int
+}
+
+type auditEntryContextKey struct{}
+
+// auditResolvedContainer records the container the request's ref resolved to, as the ref alone may be an id prefix or a name that is later reused
+func auditResolvedContainer(r *http.Request, id string) {
+	entry, ok := r.Context().Value(auditEntryContextKey{}).(*auditEntry)
+	if !ok {
+		return
+	}
+	entry.ContainerID = id
+	entry.ContainerName, _ = store.Name(id)
+}
+
+// auditLog appends an entry per request as a json line, the file is only ever appended to
+type auditLog struct {
+	Mutex    sync.Mutex
+	FilePath string
+	File     *os.File
+}
+
+func newAuditLog(filePath string) (*auditLog, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{FilePath: filePath, File: file}, nil
+}
+
+func (a *auditLog) Record(entry auditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("auditLog.Record: Marshal error: %s\n", err)
+		return
+	}
+
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	if _, err := a.File.Write(append(data, '\n')); err != nil {
+		log.Printf("auditLog.Record: Write error for %s error: %s\n", a.FilePath, err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+
+	return a.File.Close()
+}
+
+// auditQuery filters the entries, every field is optional
+type auditQuery struct {
+	User      string
+	Container string
+	Action    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (q *auditQuery) matches(entry auditEntry) bool {
+	switch {
+	case q.User != "" && entry.User != q.User:
+		return false
+	case q.Container != "" && !strings.HasPrefix(entry.Container, q.Container) && !strings.HasPrefix(entry.ContainerID, q.Container) && entry.ContainerName != q.Container:
+		return false
+	case q.Action != "" && entry.Action != q.Action:
+		return false
+	case !q.Since.IsZero() && entry.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && entry.Time.After(q.Until):
+		return false
+	}
+
+	return true
+}
+
+// Query reads the file and returns the most recent matching entries, newest first
+func (a *auditLog) Query(query *auditQuery) ([]auditEntry, error) {
+	file, err := os.Open(a.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matched []auditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A partly written last line is not a reason to fail the query
+			continue
+		}
+		if !query.matches(entry) {
+			continue
+		}
+		matched = append(matched, entry)
+		if len(matched) > query.Limit {
+			matched = matched[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]auditEntry, 0, len(matched))
+	for index := len(matched) - 1; index >= 0; index-- {
+		result = append(result, matched[index])
+	}
+
+	return result, nil
+}
+
+// auditAction describes what the request looked at, and the container it was for if any
+func auditAction(r *http.Request) (string, string) {
+	query := r.URL.Query()
+	if match := auditContainerRegexp.FindStringSubmatch(r.URL.Path); match != nil {
+		switch match[2] {
+		case "":
+			// The env is the part the compliance folk care about
+			if value := strings.TrimLeft(query.Get("path"), "$."); value == "" || value == "Config" || strings.HasPrefix(value, "Config.Env") {
+				return "view environment", match[1]
+			}
+			return "view container", match[1]
+		case "/logs":
+			return "view logs", match[1]
+		case "/metrics":
+			return "view stats", match[1]
+		case "/top":
+			return "view processes", match[1]
+		case "/changes":
+			return "view changes", match[1]
+		}
+	}
+
+	switch r.URL.Path {
+	case "/":
+		return "view dashboard", ""
+	case "/containers":
+		if watch, _ := parseBoolParameter(query.Get("watch"), false); watch {
+			return "watch containers", ""
+		}
+		if format := query.Get("format"); format == formatCSV || format == formatNDJSON || format == formatYAML {
+			return "export containers", ""
+		}
+		return "list containers", ""
+	case "/logs":
+		return "view logs", query.Get("containers")
+	case "/logs/search":
+		return "search logs", query.Get("containers")
+	case "/events":
+		return "watch events", ""
+	case "/host":
+		return "view host", ""
+	case "/system/df":
+		return "view disk usage", ""
+	case "/metrics":
+		return "view metrics", ""
+	case "/audit":
+		return "view audit", ""
+	case "/config":
+		return "view config", ""
+	}
+
+	return "request", ""
+}
+
+// statusRecorder keeps the response status for the audit entry, web socket handlers need to hijack the connection and streams need to flush
+type statusRecorder struct {
+	http.ResponseWriter
+	Status   int
+	Hijacked func() // Called once the connection is hijacked, as web sockets can stay open for hours
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.Status == 0 {
+		s.Status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response does not support hijacking")
+	}
+	// A hijacked connection is a web socket upgrade
+	s.Status = http.StatusSwitchingProtocols
+	if s.Hijacked != nil {
+		s.Hijacked()
+	}
+	return hijacker.Hijack()
+}
+
+// auditHandler records each request once it has been handled, it goes inside authentication so it knows who the user is
+func auditHandler(handler http.Handler, audit *auditLog) http.Handler {
+	if audit == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauditedPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		entry := auditEntry{
+			Time:         time.Now().UTC(),
+			RemoteAddr:   r.RemoteAddr,
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Query:        r.URL.RawQuery,
+		}
+		if id := requestIdentity(r); id != nil {
+			entry.User, entry.AuthMethod = id.Name, id.Method
+		}
+		entry.Action, entry.Container = auditAction(r)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		recorder.Hijacked = func() {
+			entry.Status = recorder.Status
+			audit.Record(entry)
+		}
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditEntryContextKey{}, &entry)))
+		if recorder.Status == http.StatusSwitchingProtocols {
+			return
+		}
+		entry.Status = recorder.Status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		audit.Record(entry)
+	})
+}
+
+// auditQueryHandler serves GET /audit?user=&container=&action=&since=&until=&limit=, for admins only
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/audit" {
+		log.Printf("auditQueryHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("auditQueryHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if audit == nil {
+		log.Printf("auditQueryHandler: Audit log is not enabled")
+		http.Error(w, "Audit log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if !requireAdmin(w, r, "auditQueryHandler") {
+		return
+	}
+
+	parameters := r.URL.Query()
+	now := time.Now()
+	query := &auditQuery{
+		User:      parameters.Get("user"),
+		Container: parameters.Get("container"),
+		Action:    parameters.Get("action"),
+	}
+	var err error
+	if query.Since, err = parseTimeParameter(parameters.Get("since"), now, time.Time{}); err != nil {
+		log.Printf("auditQueryHandler: Invalid since: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Until, err = parseTimeParameter(parameters.Get("until"), now, time.Time{}); err != nil {
+		log.Printf("auditQueryHandler: Invalid until: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Limit, err = parseCountParameter(parameters.Get("limit"), defaultAuditLimit, maxAuditLimit); err != nil {
+		log.Printf("auditQueryHandler: Invalid limit: %s", err)
+		http.Error(w, fmt.Sprintf("Invalid limit: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := audit.Query(query)
+	if err != nil {
+		log.Printf("auditQueryHandler: Query error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, "auditQueryHandler", entries)
+}
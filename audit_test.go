@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditAction(t *testing.T) {
+	tests := []struct {
+		URL       string
+		Action    string
+		Container string
+	}{
+		{"/containers/web", "view environment", "web"},
+		{"/containers/web/", "view environment", "web"},
+		{"/containers/web?path=State", "view container", "web"},
+		{"/containers/web/?path=Config.Env[0]", "view environment", "web"},
+		{"/containers/web/logs", "view logs", "web"},
+		{"/containers/web/logs/", "view logs", "web"},
+		{"/containers/web/metrics/", "view stats", "web"},
+		{"/containers/web/top/", "view processes", "web"},
+		{"/containers/web/changes/", "view changes", "web"},
+		{"/containers/web/unknown", "request", ""},
+		{"/containers/web//", "request", ""},
+		{"/containers?watch=1", "watch containers", ""},
+		{"/containers?format=csv", "export containers", ""},
+		{"/containers", "list containers", ""},
+		{"/logs?containers=web,db", "view logs", "web,db"},
+	}
+	for _, test := range tests {
+		action, container := auditAction(httptest.NewRequest("GET", test.URL, nil))
+		if action != test.Action || container != test.Container {
+			t.Errorf("%s: got %q for %q, expected %q for %q", test.URL, action, container, test.Action, test.Container)
+		}
+	}
+}
+
+func TestAuditHandlerRecordsResolvedContainer(t *testing.T) {
+	directory, err := ioutil.TempDir("", "ddash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	recorded, err := newAuditLog(filepath.Join(directory, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorded.Close()
+
+	id := "4f1c3b0e2a9d8c7b6a5f4e3d2c1b0a99887766554433221100ffeeddccbbaa99"
+	store.Mutex.Lock()
+	store.Containers[id] = container{"Id": id, "Name": "/web"}
+	store.Mutex.Unlock()
+	defer func() {
+		store.Mutex.Lock()
+		delete(store.Containers, id)
+		store.Mutex.Unlock()
+	}()
+
+	handler := auditHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/containers/4f1c3b/logs" {
+			auditResolvedContainer(r, id)
+		}
+	}), recorded)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/containers/4f1c3b/logs", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/containers/missing/logs", nil))
+
+	entries, err := recorded.Query(&auditQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, expected 2", len(entries))
+	}
+	if entry := entries[1]; entry.Container != "4f1c3b" || entry.ContainerID != id || entry.ContainerName != "web" {
+		t.Errorf("Got %#v, expected the ref, full id and name", entry)
+	}
+	if entry := entries[0]; entry.Container != "missing" || entry.ContainerID != "" || entry.ContainerName != "" {
+		t.Errorf("Got %#v, expected only the ref", entry)
+	}
+
+	// The container can be queried by the name or any prefix of the id, whatever the request used
+	for _, value := range []string{"web", "4f1c", id} {
+		if entries, _ := recorded.Query(&auditQuery{Container: value, Limit: 10}); len(entries) != 1 {
+			t.Errorf("%s: got %d entries, expected 1", value, len(entries))
+		}
+	}
+}
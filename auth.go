@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// identity is who made a request, Method is how they were authenticated
+type identity struct {
+	Name   string
+	Method string
+}
+
+type identityContextKey struct{}
+
+// authenticator checks a request's credentials, no identity and no error means the request has no credentials of this kind
+// An error means credentials were given but are not valid, the request is rejected rather than trying the other authenticators
+type authenticator interface {
+	Authenticate(r *http.Request) (*identity, error)
+}
+
+// requestIdentity returns who made the request, nil if authentication is disabled
+func requestIdentity(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityContextKey{}).(*identity)
+	return id
+}
+
+// Paths that are served without authentication, probes need to work without credentials and the oidc flow is how browsers get them
+var unauthenticatedPaths = map[string]bool{
+	"/healthz":       true,
+	"/readyz":        true,
+	oidcLoginPath:    true,
+	oidcCallbackPath: true,
+	oidcLogoutPath:   true,
+}
+
+// authHandler applies the authenticators to every request, including the web socket handshakes, before the handler sees it
+func authHandler(handler http.Handler, authenticators []authenticator) http.Handler {
+	if len(authenticators) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		for _, authenticator := range authenticators {
+			id, err := authenticator.Authenticate(r)
+			if err != nil {
+				log.Printf("authHandler: Authentication failed for %s from %s error: %s", r.URL.Path, r.RemoteAddr, err)
+				unauthorized(w, r, authenticators)
+				return
+			}
+			if id != nil {
+				handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+				return
+			}
+		}
+
+		log.Printf("authHandler: No credentials for %s from %s", r.URL.Path, r.RemoteAddr)
+		unauthorized(w, r, authenticators)
+	})
+}
+
+// unauthorized sends browsers to the oidc login if it is configured, otherwise it is a 401 with a challenge for each scheme we accept
+func unauthorized(w http.ResponseWriter, r *http.Request, authenticators []authenticator) {
+	for _, authenticator := range authenticators {
+		switch authenticator.(type) {
+		case *oidcAuthenticator:
+			if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") && r.Header.Get("Upgrade") == "" {
+				http.Redirect(w, r, oidcLoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+		case *htpasswdAuthenticator:
+			w.Header().Add("WWW-Authenticate", `Basic realm="ddash", charset="UTF-8"`)
+		case *tokenAuthenticator:
+			w.Header().Add("WWW-Authenticate", `Bearer realm="ddash"`)
+		}
+	}
+
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// htpasswdAuthenticator is basic auth against an htpasswd file, the apr1 (htpasswd's default) and {SHA} schemes are supported
+type htpasswdAuthenticator struct {
+	Users map[string]string // Name to hash
+}
+
+func newHtpasswdAuthenticator(path string) (*htpasswdAuthenticator, error) {
+	entries, err := readCredentialsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for name, hash := range entries {
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("Unsupported hash for %s in %s, use htpasswd -m or -s", name, path)
+		}
+	}
+
+	return &htpasswdAuthenticator{Users: entries}, nil
+}
+
+func (a *htpasswdAuthenticator) Authenticate(r *http.Request) (*identity, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := a.Users[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown user: %s", name)
+	}
+	var computed string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		computed = apr1Hash(password, salt)
+	}
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return nil, fmt.Errorf("Invalid password for user: %s", name)
+	}
+
+	return &identity{Name: name, Method: "basic"}, nil
+}
+
+// apr1Hash is apache's variant of the md5 crypt, see https://httpd.apache.org/docs/2.4/misc/password_encryptions.html
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	digest := md5.New()
+	digest.Write([]byte(password + magic + salt))
+	for remaining := len(password); remaining > 0; remaining -= 16 {
+		if remaining > 16 {
+			digest.Write(alternate[:])
+		} else {
+			digest.Write(alternate[:remaining])
+		}
+	}
+	for bits := len(password); bits > 0; bits >>= 1 {
+		if bits&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write([]byte(password[:1]))
+		}
+	}
+	final := digest.Sum(nil)
+
+	for round := 0; round < 1000; round++ {
+		digest := md5.New()
+		if round&1 != 0 {
+			digest.Write([]byte(password))
+		} else {
+			digest.Write(final)
+		}
+		if round%3 != 0 {
+			digest.Write([]byte(salt))
+		}
+		if round%7 != 0 {
+			digest.Write([]byte(password))
+		}
+		if round&1 != 0 {
+			digest.Write(final)
+		} else {
+			digest.Write([]byte(password))
+		}
+		final = digest.Sum(nil)
+	}
+
+	const characters = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var encoded []byte
+	encode := func(value uint, count int) {
+		for ; count > 0; count-- {
+			encoded = append(encoded, characters[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[group[0]])<<16|uint(final[group[1]])<<8|uint(final[group[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+
+	return magic + salt + "$" + string(encoded)
+}
+
+// tokenAuthenticator accepts static bearer tokens for scripts, the file has a name:token line for each token
+type tokenAuthenticator struct {
+	Tokens map[string]string // Name to token
+}
+
+func newTokenAuthenticator(path string) (*tokenAuthenticator, error) {
+	entries, err := readCredentialsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenAuthenticator{Tokens: entries}, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*identity, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	// Compare with every token so the time taken does not say which one nearly matched
+	token := []byte(strings.TrimSpace(authorization[7:]))
+	var matched string
+	for name, candidate := range a.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+			matched = name
+		}
+	}
+	if matched == "" {
+		return nil, fmt.Errorf("Invalid bearer token")
+	}
+
+	return &identity{Name: matched, Method: "token"}, nil
+}
+
+// headerAuthenticator trusts a header set by an authenticating proxy, but only on requests from the proxy's addresses
+type headerAuthenticator struct {
+	Header  string
+	Proxies []*net.IPNet
+}
+
+func newHeaderAuthenticator(header, proxies string) (*headerAuthenticator, error) {
+	authenticator := &headerAuthenticator{Header: header}
+	for _, cidr := range strings.Split(proxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy address range: %s", cidr)
+		}
+		authenticator.Proxies = append(authenticator.Proxies, network)
+	}
+	if len(authenticator.Proxies) == 0 {
+		return nil, fmt.Errorf("No proxy address ranges for the trusted header %s", header)
+	}
+
+	return authenticator, nil
+}
+
+func (a *headerAuthenticator) Authenticate(r *http.Request) (*identity, error) {
+	name := strings.TrimSpace(r.Header.Get(a.Header))
+	if name == "" {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid remote address: %s", r.RemoteAddr)
+	}
+	ip := net.ParseIP(host)
+	for _, network := range a.Proxies {
+		if ip != nil && network.Contains(ip) {
+			return &identity{Name: name, Method: "header"}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s header from %s which is not a trusted proxy", a.Header, host)
+}
+
+// readCredentialsFile reads name:value lines, blank lines and # comments are skipped
+func readCredentialsFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid line %d in %s, expected name:value", line, path)
+		}
+		entries[parts[0]] = parts[1]
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApr1Hash(t *testing.T) {
+	// From htpasswd -m, the first is the example in apache's password encryptions doc
+	tests := []struct {
+		Password string
+		Salt     string
+		Expected string
+	}{
+		{"myPassword", "r31.....", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{"myPassword", "lZL6V/ci", "$apr1$lZL6V/ci$sQw6g73nRuoOIj/gnD18Z."},
+		{"", "saltsalt", "$apr1$saltsalt$a8ml/vK5HEjiZ5oypDWA7/"},
+		{"a-much-longer-password-than-sixteen-bytes", "xxxxxxxx", "$apr1$xxxxxxxx$7oQBBij4wRy/ADls.0c.p/"},
+		// Only the first 8 characters of the salt are used
+		{"myPassword", "r31.....extra", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+	}
+	for _, test := range tests {
+		if hash := apr1Hash(test.Password, test.Salt); hash != test.Expected {
+			t.Errorf("%q with salt %q: got %s, expected %s", test.Password, test.Salt, hash, test.Expected)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	directory, err := ioutil.TempDir("", "ddash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "htpasswd")
+	// alice is htpasswd -m, bob is htpasswd -s, both with myPassword
+	content := "# Users\nalice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n\nbob:{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := newHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		Name     string
+		Password string
+		Valid    bool
+	}{
+		{"alice", "myPassword", true},
+		{"alice", "mypassword", false},
+		{"bob", "myPassword", true},
+		{"bob", "", false},
+		{"carol", "myPassword", false},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "/containers", nil)
+		request.SetBasicAuth(test.Name, test.Password)
+		id, err := authenticator.Authenticate(request)
+		if test.Valid && (err != nil || id == nil || id.Name != test.Name || id.Method != "basic") {
+			t.Errorf("%s: got %#v and %v, expected the user", test.Name, id, err)
+		}
+		if !test.Valid && (err == nil || id != nil) {
+			t.Errorf("%s with %q: expected an error", test.Name, test.Password)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/containers", nil)
+	if id, err := authenticator.Authenticate(request); id != nil || err != nil {
+		t.Errorf("No credentials: got %#v and %v, expected neither", id, err)
+	}
+
+	// Crypt and bcrypt hashes are refused when the file is read rather than never matching
+	for _, hash := range []string{"rqXexS6ZhobKA", "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC"} {
+		if err := ioutil.WriteFile(path, []byte("dave:"+hash+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newHtpasswdAuthenticator(path); err == nil {
+			t.Errorf("%s: expected an unsupported hash error", hash)
+		}
+	}
+}
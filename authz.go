@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// Policy users entry that applies to every authenticated user
+const everyUser = "*"
+
+// accessPolicy gives users or token names visibility of the containers matching any of the label selectors, All gives visibility of everything
+// Unredacted lets the users see secrets in env, labels and arguments unmasked, Admin lets them query the audit log
+type accessPolicy struct {
+	Users      []string
+	Selectors  []string
+	All        bool
+	Unredacted bool
+	Admin      bool
+}
+
+type accessPolicies struct {
+	Policies []accessPolicy
+	parsed   [][]labelSelector
+}
+
+// loadAccessPolicies reads the policy file, i.e. {"Policies": [{"Users": ["alice", "ci"], "Selectors": ["team=payments"]}, {"Users": ["admin"], "All": true}]}
+func loadAccessPolicies(path string) (*accessPolicies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded accessPolicies
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: %s", path, err)
+	}
+	for index, policy := range loaded.Policies {
+		if len(policy.Users) == 0 {
+			return nil, fmt.Errorf("Policy %d in %s has no users", index+1, path)
+		}
+		var selectors []labelSelector
+		for _, value := range policy.Selectors {
+			selector, err := parseLabelSelector(value)
+			if err != nil {
+				return nil, fmt.Errorf("Policy %d in %s: %s", index+1, path, err)
+			}
+			// An empty selector would match everything, which is what All is for
+			if len(selector) == 0 {
+				return nil, fmt.Errorf("Policy %d in %s has an empty selector, use All for every container", index+1, path)
+			}
+			selectors = append(selectors, selector)
+		}
+		loaded.parsed = append(loaded.parsed, selectors)
+	}
+
+	return &loaded, nil
+}
+
+// Scope combines every policy for the user, users with no policies see nothing
+func (p *accessPolicies) Scope(name string) *containerScope {
+	scope := &containerScope{Name: name}
+	for index, policy := range p.Policies {
+		for _, user := range policy.Users {
+			if user != name && user != everyUser {
+				continue
+			}
+			if policy.All {
+				return nil
+			}
+			scope.Selectors = append(scope.Selectors, p.parsed[index]...)
+			break
+		}
+	}
+
+	return scope
+}
+
+// Unredacted is true if any of the user's policies allow them to see secrets
+func (p *accessPolicies) Unredacted(name string) bool {
+	return p.any(name, func(policy accessPolicy) bool { return policy.Unredacted })
+}
+
+func (p *accessPolicies) Admin(name string) bool {
+	return p.any(name, func(policy accessPolicy) bool { return policy.Admin })
+}
+
+func (p *accessPolicies) any(name string, allows func(accessPolicy) bool) bool {
+	for _, policy := range p.Policies {
+		if !allows(policy) {
+			continue
+		}
+		for _, user := range policy.Users {
+			if user == name || user == everyUser {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containerScope limits the containers a caller can see, a nil scope sees every container
+type containerScope struct {
+	Name      string
+	Selectors []labelSelector // A container is visible if any selector matches
+}
+
+// requestScope is nil if no policies are configured or the caller's policies allow every container
+func requestScope(r *http.Request) *containerScope {
+	return identityScope(currentSettings(), requestIdentity(r))
+}
+
+// identityScope is the scope for the identity with the settings, for web sockets that apply the current settings to each event
+func identityScope(current *settings, id *identity) *containerScope {
+	policies := current.Policies
+	if policies == nil {
+		return nil
+	}
+	if id == nil {
+		// Authentication is required for policies so this should not happen, but if it does nothing is visible
+		return &containerScope{}
+	}
+
+	return policies.Scope(id.Name)
+}
+
+func (s *containerScope) allowsLabels(labels map[string]interface{}) bool {
+	if s == nil {
+		return true
+	}
+	for _, selector := range s.Selectors {
+		if selector.matches(labels) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *containerScope) allows(container container) bool {
+	return s.allowsLabels(containerLabels(container))
+}
+
+func (s *containerScope) filter(all containers) containers {
+	if s == nil {
+		return all
+	}
+
+	visible := containers{}
+	for _, container := range all {
+		if s.allows(container) {
+			visible = append(visible, container)
+		}
+	}
+
+	return visible
+}
+
+// requireUnscoped is for host wide resources, which callers limited to some containers can not see
+// If the caller is limited a 403 has been written and the result is false
+func requireUnscoped(w http.ResponseWriter, r *http.Request, caller string) bool {
+	if scope := requestScope(r); scope != nil {
+		log.Printf("%s: %s is limited to some containers so can not see %s", caller, scope.Name, r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// requireAdmin is for ddash's own administration, without policies everyone can see everything so everyone is an admin
+// If the caller is not an admin a 403 has been written and the result is false
+func requireAdmin(w http.ResponseWriter, r *http.Request, caller string) bool {
+	policies := currentSettings().Policies
+	if policies == nil {
+		return true
+	}
+	if id := requestIdentity(r); id != nil && policies.Admin(id.Name) {
+		return true
+	}
+
+	log.Printf("%s: Caller is not an admin so can not see %s", caller, r.URL.Path)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withSettings replaces the current settings for a test, the returned func puts the previous ones back
+func withSettings(current *settings) func() {
+	previous := configuration
+	configuration = &configWatcher{Current: current}
+
+	return func() { configuration = previous }
+}
+
+// reloadSettings replaces the settings as a reload would, while handlers may be reading them
+func reloadSettings(current *settings) {
+	configuration.Mutex.Lock()
+	defer configuration.Mutex.Unlock()
+	configuration.Current = current
+}
+
+func testPolicies(t *testing.T, content string) *accessPolicies {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "ddash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "policies.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := loadAccessPolicies(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	return policies
+}
+
+func requestAs(method, target, name string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if name == "" {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, &identity{Name: name, Method: "basic"}))
+}
+
+func TestAccessPoliciesScope(t *testing.T) {
+	policies := testPolicies(t, `{"Policies": [
+		{"Users": ["alice"], "Selectors": ["team=payments"]},
+		{"Users": ["alice", "bob"], "Selectors": ["team=orders"]},
+		{"Users": ["admin"], "All": true},
+		{"Users": ["*"], "Selectors": ["public=true"]}
+	]}`)
+	payments := map[string]interface{}{"team": "payments"}
+	orders := map[string]interface{}{"team": "orders"}
+	public := map[string]interface{}{"team": "other", "public": "true"}
+	other := map[string]interface{}{"team": "other"}
+
+	tests := []struct {
+		User    string
+		Labels  map[string]interface{}
+		Allowed bool
+	}{
+		// Every policy for the user is combined
+		{"alice", payments, true},
+		{"alice", orders, true},
+		{"alice", public, true},
+		{"alice", other, false},
+		{"alice", nil, false},
+		{"bob", payments, false},
+		{"bob", orders, true},
+		{"bob", public, true},
+		// * applies to users with no policies of their own
+		{"carol", payments, false},
+		{"carol", public, true},
+		// All sees everything, even containers without labels
+		{"admin", other, true},
+		{"admin", nil, true},
+	}
+	for _, test := range tests {
+		if allowed := policies.Scope(test.User).allowsLabels(test.Labels); allowed != test.Allowed {
+			t.Errorf("%s %v: got %v, expected %v", test.User, test.Labels, allowed, test.Allowed)
+		}
+	}
+	if scope := policies.Scope("admin"); scope != nil {
+		t.Errorf("admin: got %#v, expected no scope", scope)
+	}
+
+	// Users without a policy see nothing
+	policies = testPolicies(t, `{"Policies": [{"Users": ["alice"], "Selectors": ["team=payments"]}]}`)
+	if scope := policies.Scope("carol"); scope == nil || scope.allowsLabels(payments) || scope.allowsLabels(nil) {
+		t.Errorf("carol: got %#v, expected a scope that allows nothing", scope)
+	}
+
+	// * with All gives everyone everything
+	policies = testPolicies(t, `{"Policies": [{"Users": ["alice"], "Selectors": ["team=payments"]}, {"Users": ["*"], "All": true}]}`)
+	if scope := policies.Scope("alice"); scope != nil {
+		t.Errorf("alice with * All: got %#v, expected no scope", scope)
+	}
+}
+
+func TestRequestScope(t *testing.T) {
+	defer withSettings(&settings{})()
+	for _, name := range []string{"", "alice"} {
+		if scope := requestScope(requestAs("GET", "/containers", name)); scope != nil {
+			t.Errorf("Without policies %q: got %#v, expected no scope", name, scope)
+		}
+	}
+
+	reloadSettings(&settings{Policies: testPolicies(t, `{"Policies": [
+		{"Users": ["alice"], "Selectors": ["team=payments"]},
+		{"Users": ["admin"], "All": true}
+	]}`)})
+	payments := map[string]interface{}{"team": "payments"}
+	tests := []struct {
+		User     string
+		Scoped   bool
+		Payments bool
+	}{
+		// No identity should not happen with policies, if it does nothing is visible
+		{"", true, false},
+		{"alice", true, true},
+		{"bob", true, false},
+		{"admin", false, true},
+	}
+	for _, test := range tests {
+		scope := requestScope(requestAs("GET", "/containers", test.User))
+		if (scope != nil) != test.Scoped || scope.allowsLabels(payments) != test.Payments {
+			t.Errorf("%q: got %#v, expected scoped %v and payments %v", test.User, scope, test.Scoped, test.Payments)
+		}
+	}
+}
+
+func TestHostWideResourcesNeedAnUnscopedCaller(t *testing.T) {
+	defer withSettings(&settings{Policies: testPolicies(t, `{"Policies": [
+		{"Users": ["alice"], "Selectors": ["team=payments"]},
+		{"Users": ["admin"], "All": true}
+	]}`)})()
+
+	handlers := map[string]http.HandlerFunc{"/host": hostHandler, "/system/df": diskUsageHandler}
+	for path, handler := range handlers {
+		for _, name := range []string{"", "alice", "bob"} {
+			recorder := httptest.NewRecorder()
+			handler(recorder, requestAs("GET", path, name))
+			if recorder.Code != http.StatusForbidden {
+				t.Errorf("%s as %q: got %d, expected %d", path, name, recorder.Code, http.StatusForbidden)
+			}
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	if !requireUnscoped(recorder, requestAs("GET", "/host", "admin"), "test") || recorder.Code != http.StatusOK {
+		t.Errorf("admin: got %d, expected to be allowed", recorder.Code)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const configReloadInterval = 10 * time.Second
+
+var (
+	configuration    *configWatcher          // Created once the flags are parsed
+	commandLineFlags = make(map[string]bool) // Flags set on the command line, which win over the config file
+	// Settings applied on a reload, every other flag is only read at start up so a change is logged as needing a restart
+	liveFlags = map[string]bool{
+		"allowedorigins":   true,
+		"authfailureburst": true,
+		"authfailurelimit": true,
+		"maxclientsockets": true,
+		"maxsockets":       true,
+		"metricslabels":    true,
+		"policyfile":       true,
+		"ratelimit":        true,
+		"rateburst":        true,
+		"redactpattern":    true,
+		"stalethreshold":   true,
+	}
+	secretFlags = map[string]bool{"oidcclientsecret": true}
+)
+
+// configFile is the -config file, i.e.
+// {"Settings": {"redactpattern": "(?i)secret", "ratelimit": 10}, "Columns": ["Name", "State.Status"], "EventFilter": "status != \"exec_create\"", "Views": {"payments": "label=team=payments&sort=Name"}}
+// Settings are flags by name, Columns are the default table columns, EventFilter drops daemon events before they are sent to any subscriber
+// and Views are saved /containers and /events query strings, used as ?view=payments
+type configFile struct {
+	Settings    map[string]string
+	Columns     []string
+	EventFilter string
+	Views       map[string]string
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	file := &configFile{}
+	if path == "" {
+		return file, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded struct {
+		Settings    map[string]interface{}
+		Columns     []string
+		EventFilter string
+		Views       map[string]string
+	}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+	file.Columns, file.EventFilter, file.Views = loaded.Columns, loaded.EventFilter, loaded.Views
+
+	// Numbers and bools can be given as json values rather than strings
+	file.Settings = make(map[string]string, len(loaded.Settings))
+	for name, value := range loaded.Settings {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("Unknown setting %s in %s", name, path)
+		}
+		switch typed := value.(type) {
+		case string:
+			file.Settings[name] = typed
+		case float64:
+			file.Settings[name] = strconv.FormatFloat(typed, 'f', -1, 64)
+		case bool:
+			file.Settings[name] = strconv.FormatBool(typed)
+		default:
+			return nil, fmt.Errorf("Setting %s in %s should be a string, number or bool", name, path)
+		}
+	}
+
+	return file, nil
+}
+
+// configValues is every flag's effective value, the command line wins over the config file which wins over the defaults
+func configValues(file *configFile) map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		switch value, inFile := file.Settings[f.Name]; {
+		case commandLineFlags[f.Name]:
+			values[f.Name] = f.Value.String()
+		case inFile:
+			values[f.Name] = value
+		default:
+			values[f.Name] = f.DefValue
+		}
+	})
+
+	return values
+}
+
+// settings are what can change on a reload, they are replaced as a whole so a request sees one version
+type settings struct {
+	Redactor         *redactor       // nil if redaction is disabled
+	Policies         *accessPolicies // nil unless -policyfile is used, then every caller is limited to the containers their policies allow
+	AllowedOrigins   []string        // Web socket origins, i.e. https://ddash.example.com, * allows any, empty means the page's own origin only
+	MetricsLabelKeys []string
+	StaleThreshold   time.Duration
+	RateLimit        float64
+	RateBurst        int
+	AuthFailureLimit float64
+	AuthFailureBurst int
+	MaxSockets       int
+	MaxClientSockets int
+	Columns          []string
+	EventFilter      *filterExpression // nil if every event is sent
+	Views            map[string]url.Values
+	LoadedAt         time.Time // Part of the etags, as a reload can change what a caller sees
+}
+
+// newSettings parses the live values, authenticated is needed as policies are by user
+func newSettings(values map[string]string, file *configFile, authenticated bool) (*settings, error) {
+	result := &settings{Columns: defaultContainerColumns, Views: make(map[string]url.Values)}
+
+	var err error
+	if result.Redactor, err = newRedactor(values["redactpattern"]); err != nil {
+		return nil, fmt.Errorf("Invalid redactpattern: %s", err)
+	}
+	if path := values["policyfile"]; path != "" {
+		if !authenticated {
+			return nil, fmt.Errorf("policyfile needs authentication, as policies are by user")
+		}
+		if result.Policies, err = loadAccessPolicies(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, origin := range strings.Split(values["allowedorigins"], ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			result.AllowedOrigins = append(result.AllowedOrigins, origin)
+		}
+	}
+	if result.MetricsLabelKeys, err = parseMetricsLabelKeys(values["metricslabels"]); err != nil {
+		return nil, fmt.Errorf("Invalid metricslabels: %s", err)
+	}
+	if result.StaleThreshold, err = time.ParseDuration(values["stalethreshold"]); err != nil {
+		return nil, fmt.Errorf("Invalid stalethreshold: %s", err)
+	}
+	// The last sync only moves on with a resync, so a shorter threshold would fail /readyz between resyncs, the running interval is the one that counts
+	if result.StaleThreshold <= *resyncInterval {
+		return nil, fmt.Errorf("stalethreshold %s must be longer than resyncinterval %s", result.StaleThreshold, *resyncInterval)
+	}
+	if result.RateLimit, err = strconv.ParseFloat(values["ratelimit"], 64); err != nil {
+		return nil, fmt.Errorf("Invalid ratelimit: %s", err)
+	}
+	if result.AuthFailureLimit, err = strconv.ParseFloat(values["authfailurelimit"], 64); err != nil {
+		return nil, fmt.Errorf("Invalid authfailurelimit: %s", err)
+	}
+	counts := []struct {
+		Name   string
+		Target *int
+	}{
+		{"rateburst", &result.RateBurst},
+		{"authfailureburst", &result.AuthFailureBurst},
+		{"maxsockets", &result.MaxSockets},
+		{"maxclientsockets", &result.MaxClientSockets},
+	}
+	for _, count := range counts {
+		if *count.Target, err = strconv.Atoi(values[count.Name]); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", count.Name, err)
+		}
+	}
+
+	if len(file.Columns) > 0 {
+		if _, err := parseTableColumns(strings.Join(file.Columns, ","), nil); err != nil {
+			return nil, err
+		}
+		result.Columns = file.Columns
+	}
+	if file.EventFilter != "" {
+		if result.EventFilter, err = parseFilterExpression(file.EventFilter); err != nil {
+			return nil, fmt.Errorf("Invalid EventFilter: %s", err)
+		}
+	}
+	for name, value := range file.Views {
+		view, err := url.ParseQuery(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid view %s: %s", name, err)
+		}
+		// Views are checked here so a bad one is found on reload rather than by whoever uses it
+		if _, err := parseContainersQuery(view, time.Now()); err != nil {
+			return nil, fmt.Errorf("Invalid view %s: %s", name, err)
+		}
+		result.Views[name] = view
+	}
+
+	return result, nil
+}
+
+// currentSettings is safe to call from any go routine, callers should take it once per request
+func currentSettings() *settings {
+	configuration.Mutex.Lock()
+	defer configuration.Mutex.Unlock()
+
+	return configuration.Current
+}
+
+// configWatcher reloads the config file and the policy file when they change, a failed reload keeps the settings we have
+type configWatcher struct {
+	Mutex          sync.Mutex
+	Path           string // Empty if there is no config file, the policy file is still reloaded
+	Authenticated  bool
+	File           *configFile
+	StartValues    map[string]string // Effective values at start up, which the settings that need a restart keep
+	Values         map[string]string // Effective values from the last successful load
+	ModTimes       map[string]time.Time
+	Current        *settings
+	PendingRestart []string // Settings changed in the file that only take effect after a restart
+	LoadedAt       time.Time
+	LastError      error
+}
+
+// newConfigWatcher is called once the flags are parsed, file settings are set on the flags so values only read at start up come from the file too
+func newConfigWatcher(path string) (*configWatcher, error) {
+	watcher := &configWatcher{Path: path, ModTimes: make(map[string]time.Time)}
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		watcher.ModTimes[path] = info.ModTime()
+	}
+
+	var err error
+	if watcher.File, err = readConfigFile(path); err != nil {
+		return nil, err
+	}
+	for name, value := range watcher.File.Settings {
+		if commandLineFlags[name] {
+			log.Printf("newConfigWatcher: Setting %s in %s is ignored as it is on the command line\n", name, path)
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: %s", name, path, err)
+		}
+	}
+	watcher.StartValues = configValues(watcher.File)
+
+	return watcher, nil
+}
+
+// Start applies the settings from the file read at start up, it is called once authentication is configured
+func (c *configWatcher) Start(authenticated bool) error {
+	c.Authenticated = authenticated
+	if path := c.StartValues["policyfile"]; path != "" {
+		// Taken before the policies are read, so a change while we are loading is picked up next time
+		if info, err := os.Stat(path); err == nil {
+			c.ModTimes[path] = info.ModTime()
+		}
+	}
+
+	return c.apply(c.File, c.StartValues)
+}
+
+// Run checks the files' modification times, the policy file can change without the config file changing
+func (c *configWatcher) Run() {
+	for {
+		time.Sleep(configReloadInterval)
+
+		modTimes, err := c.modTimes()
+		if err != nil {
+			log.Printf("configWatcher.Run: Stat error: %s\n", err)
+			continue
+		}
+		c.Mutex.Lock()
+		changed := len(modTimes) != len(c.ModTimes)
+		for file, modTime := range modTimes {
+			if !modTime.Equal(c.ModTimes[file]) {
+				changed = true
+			}
+		}
+		c.Mutex.Unlock()
+		if !changed {
+			continue
+		}
+
+		if err := c.reload(modTimes); err != nil {
+			log.Printf("configWatcher.Run: Reload error, will continue with the previous settings: %s\n", err)
+			c.Mutex.Lock()
+			c.ModTimes, c.LastError = modTimes, err
+			c.Mutex.Unlock()
+			continue
+		}
+		log.Printf("configWatcher.Run: Reloaded\n")
+	}
+}
+
+func (c *configWatcher) modTimes() (map[string]time.Time, error) {
+	c.Mutex.Lock()
+	files := []string{c.Path}
+	if c.Values != nil {
+		files = append(files, c.Values["policyfile"])
+	}
+	c.Mutex.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+func (c *configWatcher) reload(modTimes map[string]time.Time) error {
+	file, err := readConfigFile(c.Path)
+	if err != nil {
+		return err
+	}
+	if err := c.apply(file, configValues(file)); err != nil {
+		return err
+	}
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.ModTimes = modTimes
+	// A policy file named for the first time in this load has been read, so it is not reloaded again on the next check
+	if path := c.Values["policyfile"]; path != "" {
+		if _, found := modTimes[path]; !found {
+			if info, err := os.Stat(path); err == nil {
+				c.ModTimes[path] = info.ModTime()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *configWatcher) apply(file *configFile, values map[string]string) error {
+	// Dropping the policy file would let everyone see everything and be an admin, so the policy file from start up is kept until a restart
+	startPolicyFile := c.StartValues["policyfile"]
+	policyFileDropped := startPolicyFile != "" && values["policyfile"] == ""
+	if policyFileDropped {
+		log.Printf("configWatcher.apply: policyfile has been removed, the policies in %s still apply until a restart\n", startPolicyFile)
+		kept := make(map[string]string, len(values))
+		for name, value := range values {
+			kept[name] = value
+		}
+		kept["policyfile"] = startPolicyFile
+		values = kept
+	}
+
+	current, err := newSettings(values, file, c.Authenticated)
+	if err != nil {
+		return err
+	}
+	current.LoadedAt = time.Now().UTC()
+
+	var pendingRestart []string
+	for name, value := range values {
+		if !liveFlags[name] && value != c.StartValues[name] {
+			pendingRestart = append(pendingRestart, name)
+		}
+	}
+	if policyFileDropped {
+		pendingRestart = append(pendingRestart, "policyfile")
+	}
+	sort.Strings(pendingRestart)
+	if len(pendingRestart) > 0 {
+		log.Printf("configWatcher.apply: Changes to %s will take effect after a restart\n", strings.Join(pendingRestart, ", "))
+	}
+
+	// Limits are updated in place as the handlers and registry hold on to them
+	requestLimiter.SetRate(current.RateLimit, current.RateBurst)
+	authFailureLimiter.SetRate(current.AuthFailureLimit, current.AuthFailureBurst)
+	openSockets.SetLimits(current.MaxSockets, current.MaxClientSockets)
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.File, c.Values, c.Current = file, values, current
+	c.PendingRestart, c.LoadedAt, c.LastError = pendingRestart, current.LoadedAt, nil
+
+	return nil
+}
+
+// applyView merges a saved view's parameters into the request's query, parameters in the request win over the view's
+func applyView(r *http.Request) error {
+	query := r.URL.Query()
+	name := query.Get("view")
+	if name == "" {
+		return nil
+	}
+	view, found := currentSettings().Views[name]
+	if !found {
+		return fmt.Errorf("Unknown view: %s", name)
+	}
+
+	for key, values := range view {
+		if _, set := query[key]; !set {
+			query[key] = values
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+
+	return nil
+}
+
+// configStatus is the effective configuration, secrets are masked
+type configStatus struct {
+	Path           string `json:",omitempty"`
+	Settings       map[string]string
+	Columns        []string
+	EventFilter    string            `json:",omitempty"`
+	Views          map[string]string `json:",omitempty"`
+	PendingRestart []string          `json:",omitempty"`
+	LoadedAt       time.Time
+	LastError      string `json:",omitempty"`
+}
+
+// configHandler serves GET /config, for admins only
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/config" {
+		log.Printf("configHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("configHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireAdmin(w, r, "configHandler") {
+		return
+	}
+
+	configuration.Mutex.Lock()
+	status := configStatus{
+		Path:           configuration.Path,
+		Settings:       make(map[string]string, len(configuration.Values)),
+		Columns:        configuration.Current.Columns,
+		EventFilter:    configuration.File.EventFilter,
+		Views:          configuration.File.Views,
+		PendingRestart: configuration.PendingRestart,
+		LoadedAt:       configuration.LoadedAt,
+	}
+	for name, value := range configuration.Values {
+		if secretFlags[name] && value != "" {
+			value = redactedValue
+		}
+		status.Settings[name] = value
+	}
+	if configuration.LastError != nil {
+		status.LastError = configuration.LastError.Error()
+	}
+	configuration.Mutex.Unlock()
+
+	writeJSON(w, "configHandler", status)
+}
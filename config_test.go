@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcherKeepsStartPolicyFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "ddash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	startPath, otherPath := filepath.Join(directory, "start.json"), filepath.Join(directory, "other.json")
+	for _, path := range []string{startPath, otherPath} {
+		if err := ioutil.WriteFile(path, []byte(`{"Policies": [{"Users": ["alice"], "Selectors": ["team=payments"]}]}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startFile := &configFile{Settings: map[string]string{"policyfile": startPath}}
+	watcher := &configWatcher{File: startFile, StartValues: configValues(startFile), ModTimes: make(map[string]time.Time)}
+	if err := watcher.Start(true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Removing the policy file would let everyone see everything, so it is kept until a restart
+	removed := &configFile{}
+	if err := watcher.apply(removed, configValues(removed)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if watcher.Current.Policies == nil || watcher.Values["policyfile"] != startPath || !reflect.DeepEqual(watcher.PendingRestart, []string{"policyfile"}) {
+		t.Errorf("Removed: got policies %v from %q pending %v, expected the start up policies pending a restart", watcher.Current.Policies, watcher.Values["policyfile"], watcher.PendingRestart)
+	}
+
+	// Another policy file still applies straight away
+	changed := &configFile{Settings: map[string]string{"policyfile": otherPath}}
+	if err := watcher.apply(changed, configValues(changed)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if watcher.Current.Policies == nil || watcher.Values["policyfile"] != otherPath || len(watcher.PendingRestart) != 0 {
+		t.Errorf("Changed: got policies %v from %q pending %v, expected the other policies", watcher.Current.Policies, watcher.Values["policyfile"], watcher.PendingRestart)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Only the fields we use from system/df, the container and image lists have the same shape so we use these for the fallback too
+type sourceDiskUsage struct {
+	LayersSize int64
+	Images     []sourceImageUsage
+	Containers []sourceContainerUsage
+	Volumes    []struct {
+		Name      string
+		Driver    string
+		UsageData *struct {
+			Size     int64 // -1 if not available
+			RefCount int64
+		}
+	}
+	BuildCache []struct {
+		ID          string
+		Type        string
+		Description string
+		InUse       bool
+		Shared      bool
+		Size        int64
+	}
+}
+
+type sourceImageUsage struct {
+	ID         string `json:"Id"`
+	RepoTags   []string
+	Size       int64
+	SharedSize int64 // -1 if not calculated
+	Containers int64 // -1 if not calculated
+}
+
+type sourceContainerUsage struct {
+	ID         string `json:"Id"`
+	Names      []string
+	Image      string
+	ImageID    string
+	State      string // Only on newer api versions, Status is always there
+	Status     string
+	SizeRw     int64
+	SizeRootFs int64
+}
+
+func (c sourceContainerUsage) running() bool {
+	if c.State != "" {
+		return c.State == "running" || c.State == "paused" || c.State == "restarting"
+	}
+
+	return strings.HasPrefix(c.Status, "Up")
+}
+
+type diskUsageItem struct {
+	ID          string `json:"Id"`
+	Name        string
+	Detail      string
+	Size        int64
+	Reclaimable int64
+}
+
+type diskUsageCategory struct {
+	Count       int
+	Active      int
+	Size        int64
+	Reclaimable int64
+	Items       []diskUsageItem
+}
+
+func (c *diskUsageCategory) add(item diskUsageItem, active bool) {
+	c.Count++
+	if active {
+		c.Active++
+	}
+	c.Size += item.Size
+	c.Reclaimable += item.Reclaimable
+	c.Items = append(c.Items, item)
+}
+
+type diskUsage struct {
+	Source     string // Which daemon endpoints the figures came from, volumes and build cache are only available from system/df
+	LayersSize int64
+	Images     diskUsageCategory
+	Containers diskUsageCategory
+	Volumes    diskUsageCategory
+	BuildCache diskUsageCategory
+}
+
+// newDiskUsage summarises the daemon's figures, using the same rules as "docker system df" for what is reclaimable
+func newDiskUsage(source *sourceDiskUsage, sourceName string) *diskUsage {
+	usage := &diskUsage{
+		Source:     sourceName,
+		LayersSize: source.LayersSize,
+	}
+	emptyItems := func(category *diskUsageCategory) { category.Items = []diskUsageItem{} }
+	emptyItems(&usage.Images)
+	emptyItems(&usage.Containers)
+	emptyItems(&usage.Volumes)
+	emptyItems(&usage.BuildCache)
+
+	for _, image := range source.Images {
+		// Older daemons do not count containers per image, so we count them from the container list
+		containers := image.Containers
+		if containers < 0 {
+			containers = 0
+			for _, container := range source.Containers {
+				if container.ImageID == image.ID || container.Image == image.ID || containsString(image.RepoTags, container.Image) {
+					containers++
+				}
+			}
+		}
+
+		item := diskUsageItem{
+			ID:     image.ID,
+			Name:   strings.Join(image.RepoTags, ", "),
+			Detail: fmt.Sprintf("%d containers", containers),
+			Size:   image.Size,
+		}
+		if containers == 0 {
+			item.Reclaimable = image.Size
+			if image.SharedSize > 0 {
+				item.Reclaimable -= image.SharedSize
+			}
+		}
+		usage.Images.add(item, containers > 0)
+	}
+
+	for _, container := range source.Containers {
+		running := container.running()
+		item := diskUsageItem{
+			ID:     container.ID,
+			Detail: strings.TrimSpace(container.Image + " " + container.Status),
+			Size:   container.SizeRw,
+		}
+		if len(container.Names) > 0 {
+			item.Name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		if !running {
+			item.Reclaimable = container.SizeRw
+		}
+		usage.Containers.add(item, running)
+	}
+
+	for _, volume := range source.Volumes {
+		item := diskUsageItem{
+			ID:     volume.Name,
+			Name:   volume.Name,
+			Detail: volume.Driver,
+		}
+		active := true
+		if volume.UsageData != nil && volume.UsageData.Size >= 0 {
+			item.Size = volume.UsageData.Size
+			active = volume.UsageData.RefCount > 0
+			if !active {
+				item.Reclaimable = item.Size
+			}
+		}
+		usage.Volumes.add(item, active)
+	}
+
+	for _, cache := range source.BuildCache {
+		item := diskUsageItem{
+			ID:     cache.ID,
+			Name:   cache.Description,
+			Detail: cache.Type,
+			Size:   cache.Size,
+		}
+		if !cache.InUse && !cache.Shared {
+			item.Reclaimable = cache.Size
+		}
+		usage.BuildCache.add(item, cache.InUse)
+	}
+
+	return usage
+}
+
+// sortAndLimit orders each category's items largest first by the sort key, keeping at most limit items if limit is positive
+func (u *diskUsage) sortAndLimit(sortKey string, limit int) error {
+	var less func(a, b diskUsageItem) bool
+	switch sortKey {
+	case "", "size":
+		less = func(a, b diskUsageItem) bool { return a.Size > b.Size }
+	case "reclaimable":
+		less = func(a, b diskUsageItem) bool { return a.Reclaimable > b.Reclaimable }
+	case "name":
+		less = func(a, b diskUsageItem) bool { return a.Name < b.Name }
+	default:
+		return fmt.Errorf("Invalid sort: %s, expected size, reclaimable or name", sortKey)
+	}
+
+	for _, category := range []*diskUsageCategory{&u.Images, &u.Containers, &u.Volumes, &u.BuildCache} {
+		items := category.Items
+		sort.SliceStable(items, func(i, j int) bool { return less(items[i], items[j]) })
+		if limit > 0 && len(items) > limit {
+			category.Items = items[:limit]
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
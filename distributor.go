@@ -7,12 +7,18 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
 type event map[string]interface{}
 
+const (
+	minEventsBackoff = time.Second
+	maxEventsBackoff = 30 * time.Second
+)
+
 var (
 	eventChannel chan event
 	eventDistr   *eventDistributor
@@ -22,28 +28,35 @@ func init() {
 	eventChannel = make(chan event)
 
 	eventDistr = &eventDistributor{
-		Incomming:   eventChannel,
-		Subscribers: make([]*subscriber, 0),
+		Incomming:          eventChannel,
+		Subscribers:        make([]*subscriber, 0),
+		ResyncRequests:     make(chan struct{}, 1),
+		Stopping:           make(chan struct{}),
+		ConnectedChangedAt: time.Now(),
 	}
 }
 
 type subscriber struct {
-	Connection          *websocket.Conn // Connection
-	DisconnectedChannel chan struct{}   // Channel used to notify subscriber http handler func that the client has been disconnected, the http handler can then terminate
+	Connection          *websocket.Conn   // Connection
+	DisconnectedChannel chan struct{}     // Channel used to notify subscriber http handler func that the client has been disconnected, the http handler can then terminate
+	Filter              *filterExpression // Optional, only events matching the filter are sent
+	Identity            *identity         // nil if authentication is disabled, the scope and redactor are taken from the current settings for each event so reloads apply to open sockets
 }
 
 type eventDistributor struct {
-	Mutex       sync.Mutex
-	Incomming   <-chan event
-	Subscribers []*subscriber
+	Mutex              sync.Mutex
+	Incomming          <-chan event
+	Subscribers        []*subscriber
+	ResyncRequests     chan struct{}
+	Stopping           chan struct{} // Closed by Stop, ends Run and the event stream
+	Connected          bool          // If the event stream from the daemon is connected
+	ConnectedChangedAt time.Time
+	LastError          error // Why the event stream last disconnected
 }
 
-func (ev *eventDistributor) Register(connection *websocket.Conn) <-chan struct{} {
-	disconnectedChannel := make(chan struct{})
-	subscriber := &subscriber{
-		Connection:          connection,
-		DisconnectedChannel: disconnectedChannel,
-	}
+// Register adds the subscriber, the returned channel is closed when the subscriber is disconnected
+func (ev *eventDistributor) Register(subscriber *subscriber) <-chan struct{} {
+	subscriber.DisconnectedChannel = make(chan struct{})
 
 	ev.Mutex.Lock()
 	defer ev.Mutex.Unlock()
@@ -52,33 +65,193 @@ func (ev *eventDistributor) Register(connection *websocket.Conn) <-chan struct{}
 	return subscriber.DisconnectedChannel
 }
 
-func (ev *eventDistributor) Run(queryer dockerQueryer) {
-	go watchForEvents(queryer, eventChannel)
+// Unregister removes the subscriber and closes its channel, it does nothing if the subscriber has already been disconnected
+func (ev *eventDistributor) Unregister(client *subscriber) {
+	ev.removeSubscribers([]*subscriber{client})
+}
+
+// removeSubscribers closes the channels of the subscribers that are still registered and removes them
+// Channels are only closed here and in disconnectAll, under the mutex, so a subscriber that goes from both the send and its read is only closed once
+func (ev *eventDistributor) removeSubscribers(subscribers []*subscriber) {
+	ev.Mutex.Lock()
+	defer ev.Mutex.Unlock()
+
+	var registered []*subscriber
+	for _, subscriber := range subscribers {
+		for _, candidate := range ev.Subscribers {
+			if candidate == subscriber {
+				close(subscriber.DisconnectedChannel)
+				registered = append(registered, subscriber)
+				break
+			}
+		}
+	}
+	ev.Subscribers = removeDisconnectedSubscribers(ev.Subscribers, registered)
+}
+
+// Stop ends Run and the event stream, subscribers are disconnected so their http handlers can terminate
+func (ev *eventDistributor) Stop() {
+	close(ev.Stopping)
+}
+
+func (ev *eventDistributor) disconnectAll() {
+	ev.Mutex.Lock()
+	defer ev.Mutex.Unlock()
+
+	log.Printf("disconnectAll: Disconnecting %d subscribers\n", len(ev.Subscribers))
+	for _, subscriber := range ev.Subscribers {
+		close(subscriber.DisconnectedChannel)
+	}
+	ev.Subscribers = make([]*subscriber, 0)
+}
+
+func (ev *eventDistributor) Run(queryer dockerQueryer, resyncInterval time.Duration) {
+	if err := store.Resync(queryer); err != nil {
+		log.Printf("Run: Resync state error, will retry: %s\n", err)
+	}
+	go ev.watch(queryer)
 
+	// Everything that changes the state store happens on this go routine so changes are applied in order
+	resyncTicker := time.NewTicker(resyncInterval)
 	for {
-		event := <-ev.Incomming
-		log.Printf("Run: Got event %#v will attempt to publish to %d subscribers\n", event, len(ev.Subscribers))
-		if len(ev.Subscribers) == 0 {
+		var event event
+		select {
+		case <-resyncTicker.C:
+			if err := store.Resync(queryer); err != nil {
+				log.Printf("Run: Resync state error: %s\n", err)
+			}
+			continue
+		case <-ev.ResyncRequests:
+			if err := store.Resync(queryer); err != nil {
+				log.Printf("Run: Resync state error: %s\n", err)
+			}
 			continue
+		case <-ev.Stopping:
+			ev.disconnectAll()
+			return
+		case event = <-ev.Incomming:
 		}
 
-		var disconnectedSubscribers []*subscriber
-		for _, subscriber := range ev.Subscribers {
-			log.Printf("Run: Sending event to %s\n", subscriber.Connection.Request().RemoteAddr)
-			if err := websocket.JSON.Send(subscriber.Connection, event); err != nil {
-				log.Printf("Run: Send error: %s\n", err)
-				switch err.(type) {
-				case *net.OpError:
-					close(subscriber.DisconnectedChannel)
-					disconnectedSubscribers = append(disconnectedSubscribers, subscriber)
-				}
+		ev.publish(queryer, event)
+	}
+}
+
+// publish applies the event to the state store and sends it to the subscribers whose filter and scope it matches
+func (ev *eventDistributor) publish(queryer dockerQueryer, event event) {
+	ev.Mutex.Lock()
+	subscribers := ev.Subscribers
+	ev.Mutex.Unlock()
+
+	log.Printf("publish: Got event %#v will attempt to publish to %d subscribers\n", event, len(subscribers))
+	selfMetrics.ObserveEvent(event, time.Now())
+	// A destroyed container is gone from the store after applying, so we keep its labels from before for the scope checks
+	id := eventContainerID(event)
+	labels, found := store.Labels(id)
+	if _, err := store.Apply(queryer, event); err != nil {
+		// The change was not recorded, we list the containers next rather than wait for the resync interval
+		ev.requestResync()
+	}
+	if len(subscribers) == 0 {
+		return
+	}
+	// The config's event filter drops events no subscriber should see, the store still has to apply them
+	current := currentSettings()
+	if filter := current.EventFilter; filter != nil && !filter.matches(event) {
+		return
+	}
+	if currentLabels, currentFound := store.Labels(id); currentFound {
+		labels, found = currentLabels, true
+	}
+
+	var disconnectedSubscribers []*subscriber
+	for _, subscriber := range subscribers {
+		if subscriber.Filter != nil && !subscriber.Filter.matches(event) {
+			continue
+		}
+		if scope := identityScope(current, subscriber.Identity); scope != nil && (!found || !scope.allowsLabels(labels)) {
+			continue
+		}
+		log.Printf("publish: Sending event to %s\n", subscriber.Connection.Request().RemoteAddr)
+		if err := websocket.JSON.Send(subscriber.Connection, identityRedactor(current, subscriber.Identity).Event(event)); err != nil {
+			log.Printf("publish: Send error: %s\n", err)
+			switch err.(type) {
+			case *net.OpError:
+				disconnectedSubscribers = append(disconnectedSubscribers, subscriber)
 			}
 		}
+	}
+
+	ev.removeSubscribers(disconnectedSubscribers)
+}
+
+// watch keeps the event stream connected, reconnecting with a backoff, we resync after reconnecting as we may have missed events
+func (ev *eventDistributor) watch(queryer dockerQueryer) {
+	var backoff time.Duration
+	for {
+		err := watchForEvents(queryer, eventChannel, ev.connected, ev.Stopping)
+		// Taken before the disconnect is recorded, so we have when the stream connected if it did
+		wasConnected, connectedAt, _ := ev.Status()
+		ev.setConnected(false, err)
+		select {
+		case <-ev.Stopping:
+			log.Println("watch: Stopped")
+			return
+		default:
+		}
+
+		backoff = eventsBackoff(backoff, wasConnected, connectedAt, time.Now())
+		log.Printf("watch: Event stream disconnected, will reconnect in %s error: %s\n", backoff, err)
+		select {
+		case <-ev.Stopping:
+			log.Println("watch: Stopped")
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
 
-		ev.Mutex.Lock()
-		ev.Subscribers = removeDisconnectedSubscribers(ev.Subscribers, disconnectedSubscribers)
-		ev.Mutex.Unlock()
+// eventsBackoff is how long to wait before reconnecting, doubling the previous wait up to the maximum
+// A stream that was up for longer than the maximum is a new failure rather than a continuing one, so we start again from the minimum
+func eventsBackoff(previous time.Duration, wasConnected bool, connectedAt, now time.Time) time.Duration {
+	if previous == 0 || (wasConnected && now.Sub(connectedAt) > maxEventsBackoff) {
+		return minEventsBackoff
 	}
+	if previous *= 2; previous > maxEventsBackoff {
+		return maxEventsBackoff
+	}
+
+	return previous
+}
+
+func (ev *eventDistributor) connected() {
+	ev.setConnected(true, nil)
+	ev.requestResync()
+}
+
+// requestResync has Run list the containers, we may have missed changes
+func (ev *eventDistributor) requestResync() {
+	select {
+	case ev.ResyncRequests <- struct{}{}:
+	default:
+		// One is already pending
+	}
+}
+
+func (ev *eventDistributor) setConnected(connected bool, err error) {
+	ev.Mutex.Lock()
+	defer ev.Mutex.Unlock()
+
+	ev.Connected = connected
+	ev.ConnectedChangedAt = time.Now()
+	ev.LastError = err
+}
+
+// Status returns if the event stream is connected, since when, and the error it last disconnected with
+func (ev *eventDistributor) Status() (bool, time.Time, error) {
+	ev.Mutex.Lock()
+	defer ev.Mutex.Unlock()
+
+	return ev.Connected, ev.ConnectedChangedAt, ev.LastError
 }
 
 func removeDisconnectedSubscribers(subscribers, disconnectedSubscribers []*subscriber) []*subscriber {
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeDaemon answers container inspects from Containers, anything else is a 404
+type fakeDaemon struct {
+	Mutex      sync.Mutex
+	Containers map[string]container
+}
+
+func (d *fakeDaemon) query(url string) (*http.Response, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	for id, document := range d.Containers {
+		if url == "containers/"+id+"/json" {
+			data, _ := json.Marshal(document)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+		}
+	}
+
+	return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(`{"message": "No such container"}`))}, nil
+}
+
+// testSubscriber connects a web socket client and registers the server's end with the distributor
+type testSubscriber struct {
+	Server *httptest.Server
+	Client *websocket.Conn
+}
+
+func newTestSubscriber(t *testing.T, ev *eventDistributor, client *subscriber) *testSubscriber {
+	t.Helper()
+	registered := make(chan struct{})
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		client.Connection = ws
+		disconnected := ev.Register(client)
+		close(registered)
+		<-disconnected
+	}))
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http:", "ws:", 1), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-registered
+
+	return &testSubscriber{Server: server, Client: ws}
+}
+
+// received reads the events sent so far, as action and id
+func (s *testSubscriber) received() []string {
+	var result []string
+	for {
+		s.Client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		var received event
+		if err := websocket.JSON.Receive(s.Client, &received); err != nil {
+			return result
+		}
+		action, _ := received["Action"].(string)
+		id, _ := received["id"].(string)
+		result = append(result, action+" "+id)
+	}
+}
+
+func testEventDaemon() *fakeDaemon {
+	return &fakeDaemon{Containers: map[string]container{
+		"web": {"Id": "web", "Name": "/web", "Config": map[string]interface{}{"Labels": map[string]interface{}{"team": "payments"}}},
+		"db":  {"Id": "db", "Name": "/db", "Config": map[string]interface{}{"Labels": map[string]interface{}{"team": "orders", "db.password": "hunter2"}}},
+	}}
+}
+
+func withTestStore() func() {
+	previous := store
+	store = newStateStore()
+
+	return func() { store = previous }
+}
+
+func TestEventDistributorScopes(t *testing.T) {
+	defer withTestStore()()
+	defer withSettings(&settings{Policies: testPolicies(t, `{"Policies": [
+		{"Users": ["alice"], "Selectors": ["team=payments"]},
+		{"Users": ["bob"], "Selectors": ["team=orders"]},
+		{"Users": ["admin"], "All": true}
+	]}`)})()
+	daemon := testEventDaemon()
+	destroys, _ := parseFilterExpression(`Action == "destroy"`)
+
+	ev := &eventDistributor{}
+	tests := []struct {
+		Name       string
+		Subscriber *subscriber
+		Expected   []string
+	}{
+		{"All", &subscriber{Identity: &identity{Name: "admin"}}, []string{"start web", "start db", "destroy web", "create net"}},
+		{"Payments", &subscriber{Identity: &identity{Name: "alice"}}, []string{"start web", "destroy web"}},
+		{"Orders", &subscriber{Identity: &identity{Name: "bob"}}, []string{"start db"}},
+		{"No policy", &subscriber{Identity: &identity{Name: "carol"}}, nil},
+		{"No identity", &subscriber{}, nil},
+		{"Filtered", &subscriber{Identity: &identity{Name: "admin"}, Filter: destroys}, []string{"destroy web"}},
+	}
+	subscribers := make([]*testSubscriber, len(tests))
+	for index, test := range tests {
+		subscribers[index] = newTestSubscriber(t, ev, test.Subscriber)
+	}
+	defer func() {
+		ev.disconnectAll()
+		for _, subscriber := range subscribers {
+			subscriber.Client.Close()
+			subscriber.Server.Close()
+		}
+	}()
+
+	ev.publish(daemon.query, event{"Type": "container", "Action": "start", "id": "web"})
+	ev.publish(daemon.query, event{"Type": "container", "Action": "start", "id": "db"})
+	// The destroyed container is gone from the daemon, and from the store once applied, so its labels from before decide who sees it
+	daemon.Mutex.Lock()
+	delete(daemon.Containers, "web")
+	daemon.Mutex.Unlock()
+	ev.publish(daemon.query, event{"Type": "container", "Action": "destroy", "id": "web"})
+	// Other events have no container, so only unscoped subscribers see them
+	ev.publish(daemon.query, event{"Type": "network", "Action": "create", "id": "net"})
+
+	for index, test := range tests {
+		if received := subscribers[index].received(); !reflect.DeepEqual(received, test.Expected) {
+			t.Errorf("%s: got %v, expected %v", test.Name, received, test.Expected)
+		}
+	}
+}
+
+func TestEventDistributorAppliesReloadedSettings(t *testing.T) {
+	defer withTestStore()()
+	masker, _ := newRedactor("(?i)password")
+	defer withSettings(&settings{Redactor: masker, Policies: testPolicies(t, `{"Policies": [{"Users": ["alice"], "Selectors": ["team=orders"]}]}`)})()
+	daemon := testEventDaemon()
+
+	ev := &eventDistributor{}
+	alice := newTestSubscriber(t, ev, &subscriber{Identity: &identity{Name: "alice"}})
+	defer func() {
+		ev.disconnectAll()
+		alice.Client.Close()
+		alice.Server.Close()
+	}()
+
+	// Newer api events have the labels as attributes, which are masked
+	dbStart := event{"Type": "container", "Action": "start", "id": "db", "Actor": map[string]interface{}{"ID": "db", "Attributes": map[string]interface{}{"db.password": "hunter2"}}}
+	ev.publish(daemon.query, dbStart)
+	alice.Client.SetReadDeadline(time.Now().Add(time.Second))
+	var received event
+	if err := websocket.JSON.Receive(alice.Client, &received); err != nil {
+		t.Fatalf("Receive error: %s", err)
+	}
+	if attributes := received["Actor"].(map[string]interface{})["Attributes"].(map[string]interface{}); attributes["db.password"] != redactedValue {
+		t.Errorf("Got attributes %v, expected the password masked", attributes)
+	}
+
+	// alice loses access to orders and is no longer masked, the open socket sees both straight away
+	reloadSettings(&settings{Policies: testPolicies(t, `{"Policies": [{"Users": ["alice"], "Selectors": ["team=payments"]}]}`)})
+	ev.publish(daemon.query, dbStart)
+	ev.publish(daemon.query, event{"Type": "container", "Action": "start", "id": "web"})
+	if received := alice.received(); !reflect.DeepEqual(received, []string{"start web"}) {
+		t.Errorf("After the reload: got %v, expected only start web", received)
+	}
+}
+
+func TestEventsBackoff(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		Name         string
+		Previous     time.Duration
+		WasConnected bool
+		ConnectedAt  time.Time
+		Expected     time.Duration
+	}{
+		{"First failure", 0, false, time.Time{}, minEventsBackoff},
+		{"Never connected", minEventsBackoff, false, time.Time{}, 2 * minEventsBackoff},
+		{"Capped", 16 * time.Second, false, time.Time{}, maxEventsBackoff},
+		{"Stays at the cap", maxEventsBackoff, false, time.Time{}, maxEventsBackoff},
+		{"Connected briefly", 8 * time.Second, true, now.Add(-time.Second), 16 * time.Second},
+		{"Connected for a while", maxEventsBackoff, true, now.Add(-time.Hour), minEventsBackoff},
+	}
+	for _, test := range tests {
+		if backoff := eventsBackoff(test.Previous, test.WasConnected, test.ConnectedAt, now); backoff != test.Expected {
+			t.Errorf("%s: got %s, expected %s", test.Name, backoff, test.Expected)
+		}
+	}
+}
+
+func TestEventDistributorResyncsWhenAnEventCanNotBeApplied(t *testing.T) {
+	defer withTestStore()()
+	defer withSettings(&settings{})()
+	daemon := testEventDaemon()
+	ev := &eventDistributor{ResyncRequests: make(chan struct{}, 1)}
+
+	ev.publish(daemon.query, event{"Type": "container", "Action": "start", "id": "web"})
+	if len(ev.ResyncRequests) != 0 {
+		t.Fatalf("Applied: got a resync request, expected none")
+	}
+
+	// The daemon is unavailable so the change is missed, a resync catches up on it
+	down := func(string) (*http.Response, error) { return nil, errors.New("Connection refused") }
+	generation := store.CurrentGeneration()
+	ev.publish(down, event{"Type": "container", "Action": "start", "id": "db"})
+	if changes, _, _, _ := store.ChangesSince(generation); len(changes) != 0 {
+		t.Errorf("Got changes %v, expected none", changes)
+	}
+	if len(ev.ResyncRequests) != 1 {
+		t.Errorf("Not applied: got no resync request, expected one")
+	}
+
+	// A pending request is enough
+	ev.publish(down, event{"Type": "container", "Action": "start", "id": "db"})
+	if len(ev.ResyncRequests) != 1 {
+		t.Errorf("Not applied again: got %d resync requests, expected one", len(ev.ResyncRequests))
+	}
+}
@@ -15,16 +15,20 @@ import (
 )
 
 const (
-	dockerAPIVersion  = "1.18" // Based on "docker version" command at this time
-	dockerDefaultHost = "unix:///var/run/docker.sock"
+	dockerAPIVersion       = "1.18" // Based on "docker version" command at this time
+	dockerSystemAPIVersion = "1.25" // system/df was only added in this version, so we use it for the system endpoints only
+	dockerDefaultHost      = "unix:///var/run/docker.sock"
 )
 
 type dockerQueryer func(string) (*http.Response, error)
 
-func newDockerQueryer(host string) dockerQueryer {
+func newDockerQueryer(host, apiVersion string) dockerQueryer {
 	return func(url string) (*http.Response, error) {
-		url = fmt.Sprintf("/v%s/%s", dockerAPIVersion, url)
-		return execGet(host, url)
+		url = fmt.Sprintf("/v%s/%s", apiVersion, url)
+		start := time.Now()
+		resp, err := execGet(host, url)
+		selfMetrics.ObserveDockerRequest(url, time.Since(start), err)
+		return resp, err
 	}
 }
 
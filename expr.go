@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter expressions are evaluated against json documents such as container inspect documents and events, i.e.
+//
+//	State.Running && Config.Labels["team"] == "payments" && HostConfig.Memory == 0
+//	status == "die" || (status =~ "^health_status" && from != "busybox")
+//
+// Operands are field paths, "string" or 'string' literals, numbers, true, false and null
+// Operators are || && ! == != < <= > >= =~ (regex match) and !~, with the usual precedence, use () to group
+// Missing fields are null, values used as conditions are false if null, false, 0, "" or empty
+type filterExpression struct {
+	Source string
+	root   exprNode
+}
+
+type exprNode interface {
+	evaluate(document interface{}) interface{}
+}
+
+func parseFilterExpression(value string) (*filterExpression, error) {
+	tokens, err := tokenizeExpression(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression: %s", err)
+	}
+
+	parser := &exprParser{Tokens: tokens}
+	root, err := parser.parseOr()
+	if err == nil && !parser.atEnd() {
+		err = fmt.Errorf("unexpected %s at %d", parser.peek().Text, parser.peek().Position)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression: %s", err)
+	}
+
+	return &filterExpression{Source: value, root: root}, nil
+}
+
+func (e *filterExpression) matches(document interface{}) bool {
+	return truthy(e.root.evaluate(document))
+}
+
+func truthy(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typed
+	case float64:
+		return typed != 0
+	case string:
+		return typed != ""
+	case []interface{}:
+		return len(typed) > 0
+	case map[string]interface{}:
+		return len(typed) > 0
+	}
+
+	return true
+}
+
+type exprTokenKind int
+
+const (
+	tokenOperator exprTokenKind = iota
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenKeyword
+)
+
+type exprToken struct {
+	Kind     exprTokenKind
+	Text     string
+	Value    interface{} // Parsed literal or field path
+	Position int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")"}
+
+func tokenizeExpression(value string) ([]exprToken, error) {
+	var tokens []exprToken
+	position := 0
+	for position < len(value) {
+		character := value[position]
+		switch {
+		case character == ' ' || character == '\t' || character == '\n' || character == '\r':
+			position++
+
+		case character == '"' || character == '\'':
+			end, text, err := scanQuoted(value, position)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{Kind: tokenString, Text: value[position:end], Value: text, Position: position})
+			position = end
+
+		case character == '-' || (character >= '0' && character <= '9'):
+			end := position + 1
+			for end < len(value) && strings.IndexByte("0123456789.eE+-", value[end]) >= 0 {
+				end++
+			}
+			number, err := strconv.ParseFloat(value[position:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", value[position:end], position)
+			}
+			tokens = append(tokens, exprToken{Kind: tokenNumber, Text: value[position:end], Value: number, Position: position})
+			position = end
+
+		case isIdentifierStart(character):
+			end, err := scanPath(value, position)
+			if err != nil {
+				return nil, err
+			}
+			text := value[position:end]
+			switch text {
+			case "true", "false":
+				tokens = append(tokens, exprToken{Kind: tokenKeyword, Text: text, Value: text == "true", Position: position})
+			case "null":
+				tokens = append(tokens, exprToken{Kind: tokenKeyword, Text: text, Position: position})
+			default:
+				path, err := parseFieldPath(text)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, exprToken{Kind: tokenPath, Text: text, Value: path, Position: position})
+			}
+			position = end
+
+		default:
+			matched := false
+			for _, operator := range exprOperators {
+				if strings.HasPrefix(value[position:], operator) {
+					tokens = append(tokens, exprToken{Kind: tokenOperator, Text: operator, Position: position})
+					position += len(operator)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %c at %d", character, position)
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+func isIdentifierStart(character byte) bool {
+	return character == '_' || (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z')
+}
+
+func isIdentifierPart(character byte) bool {
+	return isIdentifierStart(character) || (character >= '0' && character <= '9')
+}
+
+// scanQuoted returns the end of the quoted string starting at start and its unquoted text, \ escapes the next character
+func scanQuoted(value string, start int) (int, string, error) {
+	quote := value[start]
+	var text strings.Builder
+	for position := start + 1; position < len(value); position++ {
+		switch value[position] {
+		case '\\':
+			position++
+			if position == len(value) {
+				return 0, "", fmt.Errorf("unterminated string at %d", start)
+			}
+			text.WriteByte(value[position])
+		case quote:
+			return position + 1, text.String(), nil
+		default:
+			text.WriteByte(value[position])
+		}
+	}
+
+	return 0, "", fmt.Errorf("unterminated string at %d", start)
+}
+
+// scanPath returns the end of the field path starting at start, i.e. Config.Labels["team"] or Mounts[0].Source
+func scanPath(value string, start int) (int, error) {
+	position := start
+	for position < len(value) {
+		switch character := value[position]; {
+		case isIdentifierPart(character):
+			position++
+		case character == '.' && position+1 < len(value) && isIdentifierStart(value[position+1]):
+			position++
+		case character == '[':
+			position++
+			for position < len(value) && value[position] == ' ' {
+				position++
+			}
+			if position < len(value) && (value[position] == '"' || value[position] == '\'') {
+				end, _, err := scanQuoted(value, position)
+				if err != nil {
+					return 0, err
+				}
+				position = end
+			}
+			end := strings.IndexByte(value[position:], ']')
+			if end < 0 {
+				return 0, fmt.Errorf("missing ] at %d", position)
+			}
+			position += end + 1
+		default:
+			return position, nil
+		}
+	}
+
+	return position, nil
+}
+
+// Nesting deeper than this is rejected, so an expression of ((((... can not grow the stack without limit
+const maxExpressionDepth = 32
+
+type exprParser struct {
+	Tokens   []exprToken
+	Position int
+	Depth    int // Open ( and ! being parsed
+}
+
+// nest is called on entering a ( or !, the returned func is called on leaving it
+func (p *exprParser) nest() (func(), error) {
+	if p.Depth >= maxExpressionDepth {
+		return nil, fmt.Errorf("nested more than %d deep at %d", maxExpressionDepth, p.peek().Position)
+	}
+	p.Depth++
+
+	return func() { p.Depth-- }, nil
+}
+
+func (p *exprParser) atEnd() bool {
+	return p.Position >= len(p.Tokens)
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.Tokens[p.Position]
+}
+
+func (p *exprParser) acceptOperator(operators ...string) (string, bool) {
+	if p.atEnd() || p.peek().Kind != tokenOperator {
+		return "", false
+	}
+	for _, operator := range operators {
+		if p.peek().Text == operator {
+			p.Position++
+			return operator, true
+		}
+	}
+
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{Or: true, Left: left, Right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{Left: left, Right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if !p.atEnd() && p.peek().Kind == tokenOperator && p.peek().Text == "!" {
+		leave, err := p.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		p.Position++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{Operand: operand}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operator, ok := p.acceptOperator("==", "!=", "<=", ">=", "<", ">", "=~", "!~")
+	if !ok {
+		return left, nil
+	}
+
+	if operator == "=~" || operator == "!~" {
+		if p.atEnd() || p.peek().Kind != tokenString {
+			return nil, fmt.Errorf("expected a string regex after %s", operator)
+		}
+		pattern, err := regexp.Compile(p.peek().Value.(string))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex at %d: %s", p.peek().Position, err)
+		}
+		p.Position++
+		return &matchNode{Negate: operator == "!~", Operand: left, Pattern: pattern}, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	return &comparisonNode{Operator: operator, Left: left, Right: right}, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.atEnd() {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	if p.peek().Kind == tokenOperator && p.peek().Text == "(" {
+		leave, err := p.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		p.Position++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.acceptOperator(")"); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+
+	token := p.peek()
+	switch token.Kind {
+	case tokenPath:
+		p.Position++
+		return &pathNode{Path: token.Value.(fieldPath)}, nil
+	case tokenString, tokenNumber, tokenKeyword:
+		p.Position++
+		return &literalNode{Value: token.Value}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %s at %d", token.Text, token.Position)
+}
+
+type literalNode struct {
+	Value interface{}
+}
+
+func (n *literalNode) evaluate(document interface{}) interface{} {
+	return n.Value
+}
+
+type pathNode struct {
+	Path fieldPath
+}
+
+func (n *pathNode) evaluate(document interface{}) interface{} {
+	value, _ := n.Path.lookup(document)
+
+	return value
+}
+
+type notNode struct {
+	Operand exprNode
+}
+
+func (n *notNode) evaluate(document interface{}) interface{} {
+	return !truthy(n.Operand.evaluate(document))
+}
+
+type logicalNode struct {
+	Or          bool
+	Left, Right exprNode
+}
+
+func (n *logicalNode) evaluate(document interface{}) interface{} {
+	left := truthy(n.Left.evaluate(document))
+	if left == n.Or {
+		return left
+	}
+
+	return truthy(n.Right.evaluate(document))
+}
+
+type comparisonNode struct {
+	Operator    string
+	Left, Right exprNode
+}
+
+func (n *comparisonNode) evaluate(document interface{}) interface{} {
+	left, right := n.Left.evaluate(document), n.Right.evaluate(document)
+	switch n.Operator {
+	case "==":
+		return sameKind(left, right) && compareValues(left, right) == 0
+	case "!=":
+		return !sameKind(left, right) || compareValues(left, right) != 0
+	}
+
+	// Ordering only makes sense for numbers and strings, anything else is false rather than an error
+	if !sameKind(left, right) || (!isNumber(left) && !isString(left)) {
+		return false
+	}
+	result := compareValues(left, right)
+	switch n.Operator {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	}
+
+	return result >= 0
+}
+
+type matchNode struct {
+	Negate  bool
+	Operand exprNode
+	Pattern *regexp.Regexp
+}
+
+func (n *matchNode) evaluate(document interface{}) interface{} {
+	value, ok := n.Operand.evaluate(document).(string)
+
+	return ok && n.Pattern.MatchString(value) != n.Negate
+}
+
+func sameKind(a, b interface{}) bool {
+	switch a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		_, ok := b.(bool)
+		return ok
+	case float64:
+		return isNumber(b)
+	case string:
+		return isString(b)
+	}
+
+	// Lists and objects are never equal to anything, compareValues has no ordering for them
+	return false
+}
+
+func isNumber(value interface{}) bool {
+	_, ok := value.(float64)
+
+	return ok
+}
+
+func isString(value interface{}) bool {
+	_, ok := value.(string)
+
+	return ok
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var exprTestDocument = map[string]interface{}{
+	"Name": "/api",
+	"State": map[string]interface{}{
+		"Running": true,
+		"Paused":  false,
+		"Pid":     float64(42),
+	},
+	"Config": map[string]interface{}{
+		"Image":  "nginx:1.25",
+		"Labels": map[string]interface{}{"team": "payments", "com.example.tier": "web", "empty": ""},
+		"Env":    []interface{}{"A=1"},
+	},
+	"HostConfig": map[string]interface{}{"Memory": float64(0)},
+}
+
+func TestFilterExpressionOperators(t *testing.T) {
+	tests := []struct {
+		Expression string
+		Matches    bool
+	}{
+		{`State.Running`, true},
+		{`State.Paused`, false},
+		{`Missing`, false},
+		{`Config.Env`, true},
+		{`Config.Labels["empty"]`, false},
+		{`Name == "/api"`, true},
+		{`Name == '/api'`, true},
+		{`Name != "/api"`, false},
+		{`State.Pid == 42`, true},
+		{`State.Pid != 42`, false},
+		{`State.Pid < 43`, true},
+		{`State.Pid <= 42`, true},
+		{`State.Pid > 42`, false},
+		{`State.Pid >= 42`, true},
+		{`State.Pid > -1`, true},
+		{`State.Pid == 4.2e1`, true},
+		{`Name < "/b"`, true},
+		{`State.Pid == "42"`, false},
+		{`State.Pid != "42"`, true},
+		{`State.Running < true`, false},
+		{`Missing == null`, true},
+		{`Name == null`, false},
+		{`State.Running == true`, true},
+		{`State.Paused == false`, true},
+		{`Config.Image =~ "^nginx:"`, true},
+		{`Config.Image !~ "^nginx:"`, false},
+		{`State.Pid =~ "42"`, false},
+		{`Config.Labels["team"] == "payments"`, true},
+		{`Config.Labels['com.example.tier'] == "web"`, true},
+		{`!State.Paused`, true},
+		{`!!State.Running`, true},
+		{`State.Running && Config.Labels["team"] == "payments" && HostConfig.Memory == 0`, true},
+		{`State.Paused || Name == "/api"`, true},
+		{`State.Paused || Name == "/other"`, false},
+	}
+	for _, test := range tests {
+		expression, err := parseFilterExpression(test.Expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+			continue
+		}
+		if matched := expression.matches(exprTestDocument); matched != test.Matches {
+			t.Errorf("%s: got %v, expected %v", test.Expression, matched, test.Matches)
+		}
+	}
+}
+
+func TestFilterExpressionPrecedence(t *testing.T) {
+	tests := []struct {
+		Expression string
+		Matches    bool
+	}{
+		// && binds tighter than ||
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && false || true`, true},
+		{`false && (false || true)`, false},
+		// ! binds tighter than && and comparisons bind tighter than !
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!State.Pid == 42`, false},
+		{`!(State.Pid == 43)`, true},
+	}
+	for _, test := range tests {
+		expression, err := parseFilterExpression(test.Expression)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Expression, err)
+			continue
+		}
+		if matched := expression.matches(exprTestDocument); matched != test.Matches {
+			t.Errorf("%s: got %v, expected %v", test.Expression, matched, test.Matches)
+		}
+	}
+}
+
+func TestFilterExpressionQuoting(t *testing.T) {
+	document := map[string]interface{}{"Text": `say "hi" it's \ here`}
+	for _, value := range []string{`Text == "say \"hi\" it's \\ here"`, `Text == 'say "hi" it\'s \\ here'`} {
+		expression, err := parseFilterExpression(value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", value, err)
+			continue
+		}
+		if !expression.matches(document) {
+			t.Errorf("%s: expected a match", value)
+		}
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`Name ==`,
+		`== "x"`,
+		`Name == "unterminated`,
+		`Name == "trailing\`,
+		`(Name == "x"`,
+		`Name == "x")`,
+		`Name == "x" Name`,
+		`Name =~ 1`,
+		`Name =~ "("`,
+		`Name # "x"`,
+		`Labels["x"`,
+		`State.Pid == 1.2.3`,
+		`&& true`,
+		`!`,
+	}
+	for _, value := range invalid {
+		if _, err := parseFilterExpression(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestFilterExpressionDepth(t *testing.T) {
+	allowed := strings.Repeat("(", maxExpressionDepth) + "true" + strings.Repeat(")", maxExpressionDepth)
+	if _, err := parseFilterExpression(allowed); err != nil {
+		t.Errorf("Nesting %d deep: unexpected error: %s", maxExpressionDepth, err)
+	}
+
+	for _, value := range []string{
+		strings.Repeat("(", maxExpressionDepth+1) + "true" + strings.Repeat(")", maxExpressionDepth+1),
+		strings.Repeat("(", 100000),
+		strings.Repeat("!", 100000) + "true",
+	} {
+		if _, err := parseFilterExpression(value); err == nil || !strings.Contains(err.Error(), "nested") {
+			t.Errorf("Nesting %.10s...: expected a nesting error, got %v", value, err)
+		}
+	}
+
+	// Siblings do not add to the depth
+	siblings := strings.Repeat("(true) && ", 100) + "true"
+	if _, err := parseFilterExpression(siblings); err != nil {
+		t.Errorf("Siblings: unexpected error: %s", err)
+	}
+}
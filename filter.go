@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxContainersLimit = 1000
+
+var containerStatuses = []string{"created", "running", "paused", "restarting", "exited", "dead"}
+
+type sortKey struct {
+	Path       fieldPath
+	Descending bool
+}
+
+// containersQuery is the filtering, sorting, paging and projection that can be applied to the container list
+type containersQuery struct {
+	Statuses     []string
+	NameGlob     string
+	ImageGlob    string
+	Labels       labelSelector
+	Project      string
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	StartedSince time.Time
+	StartedUntil time.Time
+	Sort         []sortKey
+	Offset       int
+	Limit        int
+	Fields       []fieldPath
+	Where        *filterExpression
+	Scope        *containerScope // The containers the caller is allowed to see, applied before everything else
+	nameGlob     *regexp.Regexp
+	imageGlob    *regexp.Regexp
+}
+
+func parseContainersQuery(query url.Values, now time.Time) (*containersQuery, error) {
+	result := &containersQuery{
+		NameGlob:  query.Get("name"),
+		ImageGlob: query.Get("image"),
+		Project:   query.Get("project"),
+	}
+
+	for _, status := range strings.Split(query.Get("status"), ",") {
+		if status = strings.TrimSpace(status); status == "" {
+			continue
+		}
+		if !containsString(containerStatuses, status) {
+			return nil, fmt.Errorf("Invalid status: %s, expected one of %s", status, strings.Join(containerStatuses, ", "))
+		}
+		result.Statuses = append(result.Statuses, status)
+	}
+
+	var err error
+	if result.nameGlob, err = compileGlob(result.NameGlob); err != nil {
+		return nil, err
+	}
+	if result.imageGlob, err = compileGlob(result.ImageGlob); err != nil {
+		return nil, err
+	}
+
+	if result.Labels, err = parseLabelSelector(query.Get("label")); err != nil {
+		return nil, err
+	}
+
+	times := []struct {
+		Name   string
+		Target *time.Time
+	}{
+		{"created_since", &result.CreatedSince},
+		{"created_until", &result.CreatedUntil},
+		{"started_since", &result.StartedSince},
+		{"started_until", &result.StartedUntil},
+	}
+	for _, parameter := range times {
+		if *parameter.Target, err = parseTimeParameter(query.Get(parameter.Name), now, time.Time{}); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", parameter.Name, err)
+		}
+	}
+
+	for _, key := range splitFieldList(query.Get("sort")) {
+		descending := strings.HasPrefix(key, "-")
+		keyPath, err := parseFieldPath(strings.TrimPrefix(key, "-"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sort: %s", err)
+		}
+		result.Sort = append(result.Sort, sortKey{Path: keyPath, Descending: descending})
+	}
+
+	if result.Offset, err = parseCountParameter(query.Get("offset"), 0, -1); err != nil {
+		return nil, fmt.Errorf("Invalid offset: %s", err)
+	}
+	if result.Limit, err = parseCountParameter(query.Get("limit"), 0, maxContainersLimit); err != nil {
+		return nil, fmt.Errorf("Invalid limit: %s", err)
+	}
+
+	if where := query.Get("where"); where != "" {
+		if result.Where, err = parseFilterExpression(where); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range splitFieldList(query.Get("fields")) {
+		fieldPath, err := parseFieldPath(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid fields: %s", err)
+		}
+		result.Fields = append(result.Fields, fieldPath)
+	}
+
+	return result, nil
+}
+
+// UsesTime is true if the query has time filters, so the result can change as time passes
+func (q *containersQuery) UsesTime() bool {
+	return !q.CreatedSince.IsZero() || !q.CreatedUntil.IsZero() || !q.StartedSince.IsZero() || !q.StartedUntil.IsZero()
+}
+
+// Apply filters, sorts and pages the containers, returning the page and the number of containers that matched the filters
+func (q *containersQuery) Apply(all containers) (containers, int) {
+	matched := make(containers, 0, len(all))
+	for _, container := range all {
+		if q.matches(container) {
+			matched = append(matched, container)
+		}
+	}
+
+	if len(q.Sort) > 0 {
+		sort.SliceStable(matched, func(i, j int) bool {
+			for _, key := range q.Sort {
+				a, _ := key.Path.lookup(matched[i])
+				b, _ := key.Path.lookup(matched[j])
+				if result := compareValues(a, b); result != 0 {
+					return (result < 0) != key.Descending
+				}
+			}
+			return false
+		})
+	}
+
+	total := len(matched)
+	if q.Offset >= len(matched) {
+		return containers{}, total
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	return matched, total
+}
+
+func (q *containersQuery) matches(container container) bool {
+	if !q.Scope.allows(container) {
+		return false
+	}
+	if len(q.Statuses) > 0 && !containsString(q.Statuses, containerStatus(container)) {
+		return false
+	}
+	if q.nameGlob != nil && !q.nameGlob.MatchString(containerName(container)) {
+		return false
+	}
+	if q.imageGlob != nil {
+		image, _ := fieldPath{{Key: "Config"}, {Key: "Image"}}.lookup(container)
+		if !q.imageGlob.MatchString(fmt.Sprint(image)) {
+			return false
+		}
+	}
+
+	labels := containerLabels(container)
+	if !q.Labels.matches(labels) {
+		return false
+	}
+	if q.Project != "" && fmt.Sprint(labels[composeProjectLabel]) != q.Project {
+		return false
+	}
+
+	created := parseDocumentTime(container["Created"])
+	if !inTimeRange(created, q.CreatedSince, q.CreatedUntil) {
+		return false
+	}
+	started, _ := fieldPath{{Key: "State"}, {Key: "StartedAt"}}.lookup(container)
+	if !inTimeRange(parseDocumentTime(started), q.StartedSince, q.StartedUntil) {
+		return false
+	}
+	if q.Where != nil && !q.Where.matches(container) {
+		return false
+	}
+
+	return true
+}
+
+// SelectFields reduces each container to the requested fields, keeping the document's shape, missing fields are left out
+func (q *containersQuery) SelectFields(page containers) []interface{} {
+	result := make([]interface{}, len(page))
+	for index, container := range page {
+		if len(q.Fields) == 0 {
+			result[index] = container
+			continue
+		}
+
+		projected := make(map[string]interface{})
+		for _, field := range q.Fields {
+			if value, ok := field.lookup(container); ok {
+				field.set(projected, value)
+			}
+		}
+		result[index] = projected
+	}
+
+	return result
+}
+
+// containerStatus gives the same status as State.Status on newer api versions
+func containerStatus(container container) string {
+	state, _ := container["State"].(map[string]interface{})
+	if status, ok := state["Status"].(string); ok && status != "" {
+		return status
+	}
+
+	flag := func(name string) bool {
+		value, _ := state[name].(bool)
+		return value
+	}
+	switch {
+	case flag("Restarting"):
+		return "restarting"
+	case flag("Running") && flag("Paused"):
+		return "paused"
+	case flag("Running"):
+		return "running"
+	case flag("Dead"):
+		return "dead"
+	case parseDocumentTime(state["StartedAt"]).IsZero():
+		return "created"
+	}
+
+	return "exited"
+}
+
+// parseDocumentTime parses the daemon's timestamps, the zero time (0001-01-01T00:00:00Z) is used for never
+func parseDocumentTime(value interface{}) time.Time {
+	text, _ := value.(string)
+	timestamp, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil || timestamp.Year() <= 1 {
+		return time.Time{}
+	}
+
+	return timestamp
+}
+
+func inTimeRange(value, since, until time.Time) bool {
+	if since.IsZero() && until.IsZero() {
+		return true
+	}
+	if value.IsZero() {
+		return false
+	}
+
+	return (since.IsZero() || !value.Before(since)) && (until.IsZero() || !value.After(until))
+}
+
+// compareValues orders json values, nil first, then by type, numbers numerically and strings lexically
+// Strings that are both RFC3339 timestamps are compared as times, the daemon drops trailing zeros so 12:00:00Z would sort after 12:00:00.5Z as strings
+func compareValues(a, b interface{}) int {
+	rank := func(value interface{}) int {
+		switch value.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		case string:
+			return 3
+		}
+		return 4
+	}
+	if rankA, rankB := rank(a), rank(b); rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+
+	switch typedA := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		typedB := b.(bool)
+		if typedA == typedB {
+			return 0
+		}
+		if !typedA {
+			return -1
+		}
+		return 1
+	case float64:
+		typedB := b.(float64)
+		if typedA < typedB {
+			return -1
+		}
+		if typedA > typedB {
+			return 1
+		}
+		return 0
+	case string:
+		typedB := b.(string)
+		if timeA, err := time.Parse(time.RFC3339Nano, typedA); err == nil {
+			if timeB, err := time.Parse(time.RFC3339Nano, typedB); err == nil {
+				switch {
+				case timeA.Before(timeB):
+					return -1
+				case timeA.After(timeB):
+					return 1
+				}
+				return 0
+			}
+		}
+		return strings.Compare(typedA, typedB)
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compileGlob converts a glob to an anchored regex, nil if the glob is empty
+// Unlike path.Match a * matches across /, so *nginx* matches docker.io/library/nginx:1.25
+// ? matches any single character, [abc], [a-z] and [!abc] are classes and \ escapes the next character
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, nil
+	}
+
+	var expression strings.Builder
+	expression.WriteString("^")
+	for index := 0; index < len(glob); index++ {
+		switch glob[index] {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '\\':
+			if index++; index == len(glob) {
+				return nil, fmt.Errorf("Invalid glob: %s, trailing \\", glob)
+			}
+			expression.WriteString(regexp.QuoteMeta(glob[index : index+1]))
+		case '[':
+			end := strings.IndexByte(glob[index+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid glob: %s, missing ]", glob)
+			}
+			class := glob[index+1 : index+1+end]
+			if class == "" || class == "!" {
+				return nil, fmt.Errorf("Invalid glob: %s, empty class", glob)
+			}
+			expression.WriteString("[")
+			if class[0] == '!' {
+				expression.WriteString("^")
+				class = class[1:]
+			}
+			// QuoteMeta leaves -, so ranges still work
+			expression.WriteString(regexp.QuoteMeta(class))
+			expression.WriteString("]")
+			index += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(glob[index : index+1]))
+		}
+	}
+	expression.WriteString("$")
+
+	compiled, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid glob: %s", glob)
+	}
+
+	return compiled, nil
+}
+
+// splitFieldList splits a comma separated list of field paths, commas within [] are part of the field
+// Quoted keys within [] can contain ] and commas
+func splitFieldList(value string) []string {
+	var fields []string
+	depth, start := 0, 0
+	var quote byte
+	for index := 0; index < len(value); index++ {
+		switch character := value[index]; {
+		case quote != 0:
+			if character == '\\' {
+				index++
+			} else if character == quote {
+				quote = 0
+			}
+		case (character == '"' || character == '\'') && depth > 0:
+			quote = character
+		case character == '[':
+			depth++
+		case character == ']':
+			depth--
+		case character == ',':
+			if depth == 0 {
+				fields = append(fields, value[start:index])
+				start = index + 1
+			}
+		}
+	}
+	fields = append(fields, value[start:])
+
+	result := fields[:0]
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field != "" {
+			result = append(result, field)
+		}
+	}
+
+	return result
+}
+
+// parseCountParameter parses a non negative count, a max of -1 means no maximum
+func parseCountParameter(value string, defaultValue, max int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 || (max >= 0 && count > max) {
+		if max >= 0 {
+			return 0, fmt.Errorf("%s, expected 0 to %d", value, max)
+		}
+		return 0, fmt.Errorf("%s, expected 0 or more", value)
+	}
+
+	return count, nil
+}
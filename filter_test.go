@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		Glob    string
+		Value   string
+		Matches bool
+	}{
+		{"*nginx*", "docker.io/library/nginx:1.25", true},
+		{"nginx:*", "nginx:1.25", true},
+		{"nginx:*", "docker.io/library/nginx:1.25", false},
+		{"api-?", "api-1", true},
+		{"api-?", "api-12", false},
+		{"api-[0-9]", "api-7", true},
+		{"api-[!0-9]", "api-7", false},
+		{"api-[!0-9]", "api-x", true},
+		{"a.b", "axb", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*/redis", "registry.example.com:5000/team/redis", true},
+	}
+	for _, test := range tests {
+		glob, err := compileGlob(test.Glob)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Glob, err)
+			continue
+		}
+		if matched := glob.MatchString(test.Value); matched != test.Matches {
+			t.Errorf("%s against %s: got %v, expected %v", test.Glob, test.Value, matched, test.Matches)
+		}
+	}
+
+	for _, invalid := range []string{"api-[0-9", `api\`, "api-[]", "api-[!]", "[z-a]"} {
+		if _, err := compileGlob(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+	if glob, err := compileGlob(""); glob != nil || err != nil {
+		t.Errorf("Empty glob: got %v %v, expected nil", glob, err)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		A        interface{}
+		B        interface{}
+		Expected int
+	}{
+		{nil, false, -1},
+		{true, 1.0, -1},
+		{2.0, 10.0, -1},
+		{10.0, "1", -1},
+		{"10", "9", -1},
+		{"b", "a", 1},
+		// Timestamps are compared as times, the daemon drops trailing zeros so as strings these would be the other way round
+		{"2024-05-01T12:00:00Z", "2024-05-01T12:00:00.5Z", -1},
+		{"2024-05-01T12:00:00.123456789Z", "2024-05-01T12:00:00.12Z", 1},
+		{"2024-05-01T12:00:00.5Z", "2024-05-01T12:00:00.500Z", 0},
+		{"2024-05-01T14:00:00+02:00", "2024-05-01T12:00:00Z", 0},
+		{"0001-01-01T00:00:00Z", "2024-05-01T12:00:00Z", -1},
+		// Only when both are timestamps
+		{"2024-05-01T12:00:00Z", "2024-05-01", 1},
+		{"2024-05-01T12:00:00Z", "running", -1},
+	}
+	for _, test := range tests {
+		if result := compareValues(test.A, test.B); result != test.Expected {
+			t.Errorf("%#v and %#v: got %d, expected %d", test.A, test.B, result, test.Expected)
+		}
+		if result := compareValues(test.B, test.A); result != -test.Expected {
+			t.Errorf("%#v and %#v: got %d, expected %d", test.B, test.A, result, -test.Expected)
+		}
+	}
+
+	query, err := parseContainersQuery(url.Values{"sort": {"State.StartedAt"}}, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	documents := containers{
+		{"Name": "/b", "State": map[string]interface{}{"StartedAt": "2024-05-01T12:00:00.5Z"}},
+		{"Name": "/a", "State": map[string]interface{}{"StartedAt": "2024-05-01T12:00:00Z"}},
+		{"Name": "/c", "State": map[string]interface{}{"StartedAt": "2024-05-01T12:00:01Z"}},
+	}
+	page, _ := query.Apply(documents)
+	var names []string
+	for _, document := range page {
+		names = append(names, containerName(document))
+	}
+	if strings.Join(names, ",") != "a,b,c" {
+		t.Errorf("Sorted by start: got %v, expected a, b, c", names)
+	}
+}
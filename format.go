@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Response formats, chosen by ?format= or the Accept header, pretty json is the default as it always has been
+const (
+	formatJSON   = "json" // Compact
+	formatPretty = "pretty"
+	formatNDJSON = "ndjson"
+	formatYAML   = "yaml"
+	formatCSV    = "csv"
+	formatHTML   = "html"
+)
+
+var defaultContainerColumns = []string{"Id", "Name", "Config.Image", "State.Status", "Created", "State.StartedAt"}
+
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatPretty: "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatYAML:   "application/yaml",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatHTML:   "text/html; charset=utf-8",
+}
+
+var mediaTypeFormats = map[string]string{
+	"application/json":     formatPretty,
+	"application/x-ndjson": formatNDJSON,
+	"application/yaml":     formatYAML,
+	"application/x-yaml":   formatYAML,
+	"text/yaml":            formatYAML,
+	"text/csv":             formatCSV,
+	"text/html":            formatHTML,
+}
+
+// negotiateFormat picks the response format, ?format= wins, otherwise the Accept header's most preferred type we support
+func negotiateFormat(w http.ResponseWriter, r *http.Request) (string, error) {
+	w.Header().Add("Vary", "Accept")
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("Invalid format: %s, expected json, pretty, ndjson, yaml, csv or html", format)
+		}
+		return format, nil
+	}
+
+	// Anything we do not support is ignored rather than a 406, so odd clients still get json
+	best, bestQuality := formatPretty, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		parameters := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parameters[0]))
+		quality := 1.0
+		for _, parameter := range parameters[1:] {
+			if value := strings.TrimSpace(parameter); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+
+		format, ok := mediaTypeFormats[mediaType]
+		if !ok && (mediaType == "*/*" || mediaType == "application/*") {
+			format, ok = formatPretty, true
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+
+	return best, nil
+}
+
+// tableColumn is a named field path used for the csv and html table formats
+type tableColumn struct {
+	Name string
+	Path fieldPath
+}
+
+// parseTableColumns parses ?columns=, falling back to the defaults, no columns means they are taken from the document's keys
+func parseTableColumns(value string, defaults []string) ([]tableColumn, error) {
+	names := splitFieldList(value)
+	if len(names) == 0 {
+		names = defaults
+	}
+
+	columns := make([]tableColumn, 0, len(names))
+	for _, name := range names {
+		path, err := parseFieldPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid columns: %s", err)
+		}
+		columns = append(columns, tableColumn{Name: name, Path: path})
+	}
+
+	return columns, nil
+}
+
+// writeDocument writes the document in the format, lists are rows for the csv, html and ndjson formats
+func writeDocument(w http.ResponseWriter, caller, format, title string, document interface{}, columns []tableColumn) {
+	document = plainDocument(document)
+
+	var buffer bytes.Buffer
+	var err error
+	switch format {
+	case formatJSON:
+		err = json.NewEncoder(&buffer).Encode(document)
+	case formatNDJSON:
+		encoder := json.NewEncoder(&buffer)
+		for _, row := range documentRows(document) {
+			if err = encoder.Encode(row); err != nil {
+				break
+			}
+		}
+	case formatYAML:
+		writeYAML(&buffer, document, 0)
+	case formatCSV:
+		rows := documentRows(document)
+		columns = documentColumns(rows, columns)
+		writer := csv.NewWriter(&buffer)
+		writer.Write(columnNames(columns))
+		for _, row := range rows {
+			writer.Write(rowCells(row, columns))
+		}
+		writer.Flush()
+		err = writer.Error()
+	case formatHTML:
+		rows := documentRows(document)
+		columns = documentColumns(rows, columns)
+		table := struct {
+			Title   string
+			Columns []string
+			Rows    [][]string
+		}{
+			title,
+			columnNames(columns),
+			make([][]string, len(rows)),
+		}
+		for index, row := range rows {
+			table.Rows[index] = rowCells(row, columns)
+		}
+		err = tableTemplate.Execute(&buffer, table)
+	default:
+		var data []byte
+		if data, err = json.MarshalIndent(document, "", "    "); err == nil {
+			buffer.Write(data)
+		}
+	}
+	if err != nil {
+		log.Printf("%s: Convert to %s error: %s", caller, format, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.Write(buffer.Bytes())
+}
+
+// plainDocument converts our named map and slice types so the writers only need to deal with what json decodes to
+func plainDocument(document interface{}) interface{} {
+	switch typed := document.(type) {
+	case container:
+		return map[string]interface{}(typed)
+	case event:
+		return map[string]interface{}(typed)
+	case containers:
+		list := make([]interface{}, len(typed))
+		for index, container := range typed {
+			list[index] = map[string]interface{}(container)
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(typed))
+		for index, item := range typed {
+			list[index] = plainDocument(item)
+		}
+		return list
+	}
+
+	return document
+}
+
+func documentRows(document interface{}) []interface{} {
+	if list, ok := document.([]interface{}); ok {
+		return list
+	}
+
+	return []interface{}{document}
+}
+
+// documentColumns uses every key in the rows if no columns were given, or a single column for the value if the rows are not objects
+func documentColumns(rows []interface{}, columns []tableColumn) []tableColumn {
+	if len(columns) > 0 {
+		return columns
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, row := range rows {
+		object, ok := row.(map[string]interface{})
+		if !ok {
+			return []tableColumn{{Name: "Value"}}
+		}
+		for key := range object {
+			if !seen[key] {
+				seen[key] = true
+				names = append(names, key)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		columns = append(columns, tableColumn{Name: name, Path: fieldPath{{Key: name}}})
+	}
+
+	return columns
+}
+
+func columnNames(columns []tableColumn) []string {
+	names := make([]string, len(columns))
+	for index, column := range columns {
+		names[index] = column.Name
+	}
+
+	return names
+}
+
+func rowCells(row interface{}, columns []tableColumn) []string {
+	cells := make([]string, len(columns))
+	for index, column := range columns {
+		value, _ := column.Path.lookup(row)
+		cells[index] = cellText(value)
+	}
+
+	return cells
+}
+
+// cellText writes scalars as they are and anything else as compact json
+func cellText(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typed)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return string(data)
+}
+
+// writeYAML writes block style yaml, keys are sorted so the output is stable
+func writeYAML(buffer *bytes.Buffer, value interface{}, indent int) {
+	prefix := strings.Repeat(" ", indent)
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if len(typed) == 0 {
+			buffer.WriteString(prefix + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buffer.WriteString(prefix + yamlScalar(key) + ":")
+			writeYAMLValue(buffer, typed[key], indent+2)
+		}
+
+	case []interface{}:
+		if len(typed) == 0 {
+			buffer.WriteString(prefix + "[]\n")
+			return
+		}
+		for _, item := range typed {
+			if isYAMLCollection(item) {
+				// The item's first line goes on the same line as the -
+				var nested bytes.Buffer
+				writeYAML(&nested, item, indent+2)
+				buffer.WriteString(prefix + "- ")
+				buffer.Write(nested.Bytes()[indent+2:])
+				continue
+			}
+			buffer.WriteString(prefix + "- " + yamlScalar(item) + "\n")
+		}
+
+	default:
+		buffer.WriteString(prefix + yamlScalar(typed) + "\n")
+	}
+}
+
+func writeYAMLValue(buffer *bytes.Buffer, value interface{}, indent int) {
+	if isYAMLCollection(value) {
+		buffer.WriteString("\n")
+		writeYAML(buffer, value, indent)
+		return
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		buffer.WriteString(" {}\n")
+	case []interface{}:
+		buffer.WriteString(" []\n")
+	default:
+		buffer.WriteString(" " + yamlScalar(typed) + "\n")
+	}
+}
+
+// isYAMLCollection is true for non empty objects and lists, which are written over several lines
+func isYAMLCollection(value interface{}) bool {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return len(typed) > 0
+	case []interface{}:
+		return len(typed) > 0
+	}
+
+	return false
+}
+
+func yamlScalar(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(typed)
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case string:
+		if yamlNeedsQuotes(typed) {
+			// A json string is a valid yaml double quoted string
+			data, _ := json.Marshal(typed)
+			return string(data)
+		}
+		return typed
+	}
+
+	return fmt.Sprint(value)
+}
+
+func yamlNeedsQuotes(value string) bool {
+	if value == "" || strings.TrimSpace(value) != value {
+		return true
+	}
+	switch strings.ToLower(value) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return true
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return true
+	}
+	// Digits could be read as numbers, dates or times
+	if strings.ContainsAny(value[:1], "0123456789.+-?:,[]{}#&*!|>'\"%@`") {
+		return true
+	}
+
+	return strings.Contains(value, ": ") || strings.Contains(value, " #") || strings.ContainsAny(value, "\n\r\t\\") || strings.HasSuffix(value, ":")
+}
@@ -1,28 +1,96 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
+// Container references in paths can be a full id, a unique id prefix or a name
+const containerRefPattern = `[a-zA-Z0-9][a-zA-Z0-9_.-]*`
+
 var (
-	containerPathRegexp *regexp.Regexp
+	containerPathRegexp        *regexp.Regexp
+	containerMetricsPathRegexp *regexp.Regexp
+	containerLogsPathRegexp    *regexp.Regexp
+	containerTopPathRegexp     *regexp.Regexp
+	containerChangesPathRegexp *regexp.Regexp
+	fullContainerIDRegexp      *regexp.Regexp
+	psArgsRegexp               *regexp.Regexp
 )
 
 func init() {
 	var err error
-	containerPathRegexp, err = regexp.Compile(`^/containers/\w{64}/?$`)
+	containerPathRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)/?$`)
 	if err != nil {
 		panic(fmt.Sprintf("Container regex error : %s", err))
 	}
+
+	containerMetricsPathRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)/metrics/?$`)
+	if err != nil {
+		panic(fmt.Sprintf("Container metrics regex error : %s", err))
+	}
+
+	containerLogsPathRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)/logs/?$`)
+	if err != nil {
+		panic(fmt.Sprintf("Container logs regex error : %s", err))
+	}
+
+	containerTopPathRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)/top/?$`)
+	if err != nil {
+		panic(fmt.Sprintf("Container top regex error : %s", err))
+	}
+
+	containerChangesPathRegexp, err = regexp.Compile(`^/containers/(` + containerRefPattern + `)/changes/?$`)
+	if err != nil {
+		panic(fmt.Sprintf("Container changes regex error : %s", err))
+	}
+
+	fullContainerIDRegexp, err = regexp.Compile(`^[0-9a-f]{64}$`)
+	if err != nil {
+		panic(fmt.Sprintf("Full container id regex error : %s", err))
+	}
+
+	// ps options only, i.e. aux, -eo pid,ppid,stat,args or -o pid,%cpu,%mem,args --sort=-%cpu,+pid
+	psArgsRegexp, err = regexp.Compile(`^[\w ,=%+-]{0,100}$`)
+	if err != nil {
+		panic(fmt.Sprintf("ps args regex error : %s", err))
+	}
 }
 
 func containerHandler(w http.ResponseWriter, r *http.Request) {
+	// Sub resources share the /containers/ prefix registration
+	if containerMetricsPathRegexp.MatchString(r.URL.Path) {
+		containerMetricsHandler(w, r)
+		return
+	}
+	if containerLogsPathRegexp.MatchString(r.URL.Path) {
+		containerLogsHandler(w, r)
+		return
+	}
+	if containerTopPathRegexp.MatchString(r.URL.Path) {
+		containerTopHandler(w, r)
+		return
+	}
+	if containerChangesPathRegexp.MatchString(r.URL.Path) {
+		containerChangesHandler(w, r)
+		return
+	}
+
 	if !containerPathRegexp.MatchString(r.URL.Path) {
 		log.Printf("containerHandler: Unsupported url: %s", r.URL.Path)
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -35,11 +103,50 @@ func containerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	startIndex := len("/containers/")
-	id := r.URL.Path[startIndex:]
+	query := r.URL.Query()
+	var documentPath fieldPath
+	if value := query.Get("path"); value != "" {
+		var err error
+		if documentPath, err = parseDocumentPath(value); err != nil {
+			log.Printf("containerHandler: Invalid path: %s error: %s", value, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	raw := query.Get("format") == "raw"
+	format := formatPretty
+	if !raw {
+		var err error
+		if format, err = negotiateFormat(w, r); err != nil {
+			log.Printf("containerHandler: Negotiate format error: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// A single container's table has every top level field as a column unless columns are given
+	columns, err := parseTableColumns(query.Get("columns"), nil)
+	if err != nil {
+		log.Printf("containerHandler: Parse columns error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Read before resolving the reference, which queries the daemon, and checked after so an unknown or hidden container is still a 404
+	generation := store.CurrentGeneration()
+	id, ok := resolveContainerPath(w, r, containerPathRegexp, "containerHandler")
+	if !ok {
+		return
+	}
+	etagFormat := format
+	if raw {
+		etagFormat = "raw"
+	}
+	if checkNotModified(w, r, generation, etagFormat) {
+		return
+	}
 
 	found, container, err := getContainer(queryer, id)
-	if !found {
+	if err == nil && !found {
 		log.Printf("containerHandler: Container not found for id: %s", id)
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -50,15 +157,515 @@ func containerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	prettyJSONData, err := json.MarshalIndent(container, "", "    ")
+	var document interface{} = requestRedactor(r).Container(container)
+	if documentPath != nil {
+		if document, found = documentPath.lookup(document); !found {
+			log.Printf("containerHandler: Path not found for id: %s path: %s", id, query.Get("path"))
+			http.Error(w, fmt.Sprintf("Path not found: %s", query.Get("path")), http.StatusNotFound)
+			return
+		}
+	}
+
+	if raw {
+		writeRawValue(w, document)
+		return
+	}
+
+	writeDocument(w, "containerHandler", format, containerName(container), document, columns)
+}
+
+func containerMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("containerMetricsHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if metricsHist == nil {
+		log.Printf("containerMetricsHandler: Stats sampling is not enabled")
+		http.Error(w, "Stats sampling is not enabled", http.StatusNotFound)
+		return
+	}
+
+	// Removed containers can no longer be resolved, but their history is kept for a while so we allow the full id
+	// Callers limited to some containers can only see the ones that still exist, as we no longer know a removed container's labels
+	ref := containerMetricsPathRegexp.FindStringSubmatch(r.URL.Path)[1]
+	id := ref
+	if !fullContainerIDRegexp.MatchString(ref) || requestScope(r) != nil {
+		var ok bool
+		if id, ok = resolveContainerPath(w, r, containerMetricsPathRegexp, "containerMetricsHandler"); !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	query := r.URL.Query()
+	from, err := parseTimeParameter(query.Get("from"), now, now.Add(-time.Hour))
+	if err != nil {
+		log.Printf("containerMetricsHandler: Invalid from for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParameter(query.Get("to"), now, now)
+	if err != nil {
+		log.Printf("containerMetricsHandler: Invalid to for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		if step, err = time.ParseDuration(value); err != nil || step < 0 {
+			log.Printf("containerMetricsHandler: Invalid step for id: %s step: %s", id, value)
+			http.Error(w, fmt.Sprintf("Invalid step: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// No series just means we have not sampled the container (yet), so we return an empty series rather than a 404
+	_, points := metricsHist.Query(id, from, to, step, now)
+
+	metrics := struct {
+		ID     string `json:"Id"`
+		From   time.Time
+		To     time.Time
+		Step   string
+		Points []metricsPoint
+	}{
+		id,
+		from,
+		to,
+		step.String(),
+		points,
+	}
+
+	writeJSON(w, "containerMetricsHandler", metrics)
+}
+
+func containerLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("containerLogsHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := resolveContainerPath(w, r, containerLogsPathRegexp, "containerLogsHandler")
+	if !ok {
+		return
+	}
+
+	// Follow mode is a web socket on the same url
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		trackedWebsocket(func(ws *websocket.Conn) { containerLogsFollowHandler(ws, id) }).ServeHTTP(w, r)
+		return
+	}
+
+	options, err := parseLogOptions(r.URL.Query(), time.Now())
+	if err != nil {
+		log.Printf("containerLogsHandler: Invalid options for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// We need to know if the container has a tty to know if the log stream is multiplexed
+	found, container, err := getContainer(queryer, id)
+	if err != nil {
+		log.Printf("containerLogsHandler: Get container error for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		log.Printf("containerLogsHandler: Container not found for id: %s", id)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	found, logs, err := getContainerLogs(queryer, id, options)
 	if err != nil {
-		log.Printf("containerHandler: Convert to pretty json data error for id: %s error: %s", id, err)
+		log.Printf("containerLogsHandler: Get logs error for id: %s error: %s", id, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !found {
+		log.Printf("containerLogsHandler: Container not found for id: %s", id)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer logs.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(prettyJSONData))
+	// Logs can be large so we stream them rather than building the response in memory
+	asJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "[")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	count := 0
+	err = readLogEntries(logs, isTtyContainer(container), func(entry logEntry) error {
+		if !options.includes(entry) {
+			return nil
+		}
+
+		if !asJSON {
+			_, err := io.WriteString(w, options.render(entry))
+			return err
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			io.WriteString(w, ",")
+		}
+		count++
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		// Too late to change the status code
+		log.Printf("containerLogsHandler: Read logs error for id: %s error: %s", id, err)
+	}
+
+	if asJSON {
+		io.WriteString(w, "]")
+	}
+}
+
+func containerLogsFollowHandler(ws *websocket.Conn, id string) {
+	r := ws.Request()
+	log.Printf("containerLogsFollowHandler: Following logs for id: %s for %s\n", id, r.RemoteAddr)
+
+	sendError := func(err error) {
+		websocket.JSON.Send(ws, struct{ Error string }{err.Error()})
+	}
+
+	options, err := parseLogOptions(r.URL.Query(), time.Now())
+	if err != nil {
+		log.Printf("containerLogsFollowHandler: Invalid options for id: %s error: %s", id, err)
+		sendError(err)
+		return
+	}
+	options.Follow = true
+
+	found, container, err := getContainer(queryer, id)
+	if err == nil && !found {
+		err = fmt.Errorf("Container not found for id: %s", id)
+	}
+	if err != nil {
+		log.Printf("containerLogsFollowHandler: Get container error for id: %s error: %s", id, err)
+		sendError(err)
+		return
+	}
+
+	found, logs, err := getContainerLogs(queryer, id, options)
+	if err == nil && !found {
+		err = fmt.Errorf("Container not found for id: %s", id)
+	}
+	if err != nil {
+		log.Printf("containerLogsFollowHandler: Get logs error for id: %s error: %s", id, err)
+		sendError(err)
+		return
+	}
+	defer logs.Close()
+
+	// We never expect messages from the client, a read error means it has gone so we stop following
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		logs.Close()
+	}()
+
+	err = readLogEntries(logs, isTtyContainer(container), func(entry logEntry) error {
+		if !options.includes(entry) {
+			return nil
+		}
+		return websocket.JSON.Send(ws, entry)
+	})
+	log.Printf("containerLogsFollowHandler: Closing for id: %s for %s error: %v\n", id, r.RemoteAddr, err)
+}
+
+func containerTopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("containerTopHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	psArgs := r.URL.Query().Get("ps_args")
+	if !psArgsRegexp.MatchString(psArgs) {
+		log.Printf("containerTopHandler: Invalid ps_args: %s", psArgs)
+		http.Error(w, fmt.Sprintf("Invalid ps_args: %s", psArgs), http.StatusBadRequest)
+		return
+	}
+
+	id, ok := resolveContainerPath(w, r, containerTopPathRegexp, "containerTopHandler")
+	if !ok {
+		return
+	}
+
+	found, top, err := getContainerTop(queryer, id, psArgs)
+	if err != nil {
+		log.Printf("containerTopHandler: Get top error for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		log.Printf("containerTopHandler: Container not found for id: %s", id)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, "containerTopHandler", requestRedactor(r).Top(top))
+}
+
+func containerChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("containerChangesHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			log.Printf("containerChangesHandler: Invalid prefix: %s", prefix)
+			http.Error(w, fmt.Sprintf("Invalid prefix: %s, must be an absolute path", prefix), http.StatusBadRequest)
+			return
+		}
+		prefix = path.Clean(prefix)
+	}
+
+	id, ok := resolveContainerPath(w, r, containerChangesPathRegexp, "containerChangesHandler")
+	if !ok {
+		return
+	}
+
+	found, changes, err := getContainerChanges(queryer, id)
+	if err != nil {
+		log.Printf("containerChangesHandler: Get changes error for id: %s error: %s", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		log.Printf("containerChangesHandler: Container not found for id: %s", id)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	grouped := struct {
+		Added    []string
+		Modified []string
+		Deleted  []string
+	}{
+		[]string{},
+		[]string{},
+		[]string{},
+	}
+	for _, change := range changes {
+		if prefix != "" && prefix != "/" && change.Path != prefix && !strings.HasPrefix(change.Path, prefix+"/") {
+			continue
+		}
+
+		switch change.Kind {
+		case 0:
+			grouped.Modified = append(grouped.Modified, change.Path)
+		case 1:
+			grouped.Added = append(grouped.Added, change.Path)
+		case 2:
+			grouped.Deleted = append(grouped.Deleted, change.Path)
+		}
+	}
+	sort.Strings(grouped.Added)
+	sort.Strings(grouped.Modified)
+	sort.Strings(grouped.Deleted)
+
+	writeJSON(w, "containerChangesHandler", grouped)
+}
+
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/logs" {
+		log.Printf("logsHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Follow mode is a web socket on the same url
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		trackedWebsocket(logsFollowHandler).ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("logsHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	options, selection, err := parseMergedLogsQuery(r)
+	if err != nil {
+		log.Printf("logsHandler: Invalid query: %s error: %s", r.URL.RawQuery, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	containers, err := selection.Select(queryer)
+	if err != nil {
+		log.Printf("logsHandler: Select containers error: %s", err)
+		http.Error(w, err.Error(), selectionErrorStatusCode(err))
+		return
+	}
+
+	entries, err := getMergedLogs(queryer, containers, options)
+	if err != nil {
+		log.Printf("logsHandler: Get merged logs error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, "logsHandler", entries)
+		return
+	}
+
+	nameWidth := 0
+	for _, container := range containers {
+		if width := len(containerName(container)); width > nameWidth {
+			nameWidth = width
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, entry := range entries {
+		io.WriteString(w, options.renderTagged(entry, nameWidth))
+	}
+}
+
+func logsFollowHandler(ws *websocket.Conn) {
+	r := ws.Request()
+	log.Printf("logsFollowHandler: Following merged logs for %s query: %s\n", r.RemoteAddr, r.URL.RawQuery)
+
+	sendError := func(err error) {
+		websocket.JSON.Send(ws, struct{ Error string }{err.Error()})
+	}
+
+	options, selection, err := parseMergedLogsQuery(r)
+	if err != nil {
+		log.Printf("logsFollowHandler: Invalid query: %s error: %s", r.URL.RawQuery, err)
+		sendError(err)
+		return
+	}
+	options.Follow = true
+
+	containers, err := selection.Select(queryer)
+	if err != nil {
+		log.Printf("logsFollowHandler: Select containers error: %s", err)
+		sendError(err)
+		return
+	}
+
+	// We never expect messages from the client, a read error means it has gone so we stop following
+	stop := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(stop)
+	}()
+
+	err = followMergedLogs(queryer, containers, options, stop, func(entry taggedLogEntry) error {
+		return websocket.JSON.Send(ws, entry)
+	})
+	log.Printf("logsFollowHandler: Closing for %s error: %v\n", r.RemoteAddr, err)
+}
+
+func logsSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/logs/search" {
+		log.Printf("logsSearchHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("logsSearchHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	search, err := parseLogSearch(query)
+	if err != nil {
+		log.Printf("logsSearchHandler: Invalid search: %s error: %s", r.URL.RawQuery, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options, err := parseLogOptions(query, time.Now())
+	if err != nil {
+		log.Printf("logsSearchHandler: Invalid log options: %s error: %s", r.URL.RawQuery, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// No selection means search every container
+	selection, err := parseContainerSelection(query, maxLogSearchContainers, true)
+	if err != nil {
+		log.Printf("logsSearchHandler: Invalid selection: %s error: %s", r.URL.RawQuery, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selection.Scope = requestScope(r)
+
+	containers, err := selection.Select(queryer)
+	if err != nil {
+		log.Printf("logsSearchHandler: Select containers error: %s", err)
+		http.Error(w, err.Error(), selectionErrorStatusCode(err))
+		return
+	}
+
+	// Results are streamed as newline delimited json as they are found, the last line is a summary
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	err = search.Run(queryer, containers, options, func(result interface{}) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("logsSearchHandler: Search ended early for %s error: %s", r.RemoteAddr, err)
+	}
+}
+
+// Merged logs default to a tail per container, as the whole log of several containers can be huge
+func parseMergedLogsQuery(r *http.Request) (*logOptions, *containerSelection, error) {
+	query := r.URL.Query()
+
+	options, err := parseLogOptions(query, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	if query.Get("tail") == "" {
+		options.Tail = defaultMergedLogsTail
+	}
+
+	selection, err := parseContainerSelection(query, maxMergedLogsContainers, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	selection.Scope = requestScope(r)
+
+	return options, selection, nil
+}
+
+func selectionErrorStatusCode(err error) int {
+	if _, ok := err.(*selectionError); ok {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
 }
 
 func containersHandler(w http.ResponseWriter, r *http.Request) {
@@ -74,6 +681,57 @@ func containersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := applyView(r); err != nil {
+		log.Printf("containersHandler: View error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := parseContainersQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		log.Printf("containersHandler: Parse query error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Scope = requestScope(r)
+
+	watch, err := parseBoolParameter(r.URL.Query().Get("watch"), false)
+	if err != nil {
+		log.Printf("containersHandler: Invalid watch: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if watch {
+		containersWatchHandler(w, r, query)
+		return
+	}
+
+	format, err := negotiateFormat(w, r)
+	if err != nil {
+		log.Printf("containersHandler: Negotiate format error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Table columns default to the selected fields if there are any
+	defaultColumns := currentSettings().Columns
+	if fields := splitFieldList(r.URL.Query().Get("fields")); len(fields) > 0 {
+		defaultColumns = fields
+	}
+	columns, err := parseTableColumns(r.URL.Query().Get("columns"), defaultColumns)
+	if err != nil {
+		log.Printf("containersHandler: Parse columns error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The version is read before querying the daemon, so the list includes at least every change up to it and can be watched from it
+	generation := store.CurrentGeneration()
+	w.Header().Set("X-Resource-Version", strconv.FormatInt(generation, 10))
+
+	// Time filters can change the result without a docker event so we cannot use the generation to validate those
+	if !query.UsesTime() && checkNotModified(w, r, generation, format) {
+		return
+	}
+
 	containers, err := getContainers(queryer)
 	if err != nil {
 		log.Printf("containersHandler: Get containers error: %s", err)
@@ -81,22 +739,284 @@ func containersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	prettyJSONData, err := json.MarshalIndent(containers, "", "    ")
+	// Masked before filtering so secrets can not be found by filtering on them
+	page, total := query.Apply(requestRedactor(r).Containers(containers))
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	writeDocument(w, "containersHandler", format, "Containers", query.SelectFields(page), columns)
+}
+
+type watchEvent struct {
+	Type            string
+	ResourceVersion int64
+	Object          interface{}
+}
+
+// containersWatchHandler streams container changes as newline delimited json, in the style of a kubernetes watch
+// Without a resourceVersion the current containers are sent as ADDED first, with one we send the changes after it
+// If the version is no longer in the history we return a 410, or send an ERROR with a 410 code if we fall behind while watching
+// A reload that changes what the caller can see also ends the watch with an ERROR with a 410 code, so the caller lists again with the new settings
+func containersWatchHandler(w http.ResponseWriter, r *http.Request, query *containersQuery) {
+	parameters := r.URL.Query()
+	timeoutSeconds, err := parseCountParameter(parameters.Get("timeoutSeconds"), 0, -1)
 	if err != nil {
-		log.Printf("containersHandler: Convert to pretty json data error: %s", err)
+		log.Printf("containersWatchHandler: Invalid timeoutSeconds: %s", err)
+		http.Error(w, fmt.Sprintf("Invalid timeoutSeconds: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	redactor := requestRedactor(r)
+	var initial []watchEvent
+	var changes []stateChange
+	var version int64
+	var changed <-chan struct{}
+	if value := parameters.Get("resourceVersion"); value != "" {
+		if version, err = strconv.ParseInt(value, 10, 64); err != nil {
+			log.Printf("containersWatchHandler: Invalid resourceVersion: %s", value)
+			http.Error(w, fmt.Sprintf("Invalid resourceVersion: %s", value), http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if changes, version, changed, ok = store.ChangesSince(version); !ok {
+			log.Printf("containersWatchHandler: Resource version is too old: %s", value)
+			http.Error(w, fmt.Sprintf("Resource version %s is too old, list again and watch from the list's X-Resource-Version", value), http.StatusGone)
+			return
+		}
+	} else {
+		var current containers
+		current, version, changed = store.Snapshot()
+		for _, container := range redactor.Containers(current) {
+			if query.matches(container) {
+				initial = append(initial, watchEvent{changeAdded, version, query.SelectFields(containers{container})[0]})
+			}
+		}
+	}
+
+	var timeout <-chan time.Time
+	if timeoutSeconds > 0 {
+		timeout = time.After(time.Duration(timeoutSeconds) * time.Second)
+	}
+
+	w.Header().Set("Content-Type", "application/json;stream=watch")
+	w.Header().Set("X-Resource-Version", strconv.FormatInt(version, 10))
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(events []watchEvent) error {
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	events := initial
+	for {
+		for _, change := range changes {
+			if event, ok := watchEventForChange(query, redactor, change); ok {
+				events = append(events, event)
+			}
+		}
+		if err := send(events); err != nil {
+			log.Printf("containersWatchHandler: Send error for %s error: %s", r.RemoteAddr, err)
+			return
+		}
+		events = nil
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		case <-shutdownChannel:
+			return
+		}
+
+		var ok bool
+		if changes, version, changed, ok = store.ChangesSince(version); !ok {
+			log.Printf("containersWatchHandler: Watcher fell behind the history for %s", r.RemoteAddr)
+			send([]watchEvent{{"ERROR", version, map[string]interface{}{"Code": http.StatusGone, "Message": "Watch fell behind the history, list again"}}})
+			return
+		}
+		if !reflect.DeepEqual(requestScope(r), query.Scope) || requestRedactor(r).Pattern() != redactor.Pattern() {
+			log.Printf("containersWatchHandler: Settings changed what %s can see", r.RemoteAddr)
+			send([]watchEvent{{"ERROR", version, map[string]interface{}{"Code": http.StatusGone, "Message": "Settings changed what you can see, list again"}}})
+			return
+		}
+	}
+}
+
+// watchEventForChange converts the change to a watch event for the query, containers that stop matching the filters are DELETED and those that start matching are ADDED
+func watchEventForChange(query *containersQuery, redactor *redactor, change stateChange) (watchEvent, bool) {
+	change.Previous = redactor.Container(change.Previous)
+	change.Current = redactor.Container(change.Current)
+	previousMatched := change.Previous != nil && query.matches(change.Previous)
+	currentMatched := change.Current != nil && query.matches(change.Current)
+
+	var eventType string
+	object := change.Current
+	switch {
+	case previousMatched && currentMatched:
+		eventType = changeModified
+	case currentMatched:
+		eventType = changeAdded
+	case previousMatched:
+		eventType = changeDeleted
+		if object == nil {
+			object = change.Previous
+		}
+	default:
+		return watchEvent{}, false
+	}
+
+	return watchEvent{eventType, change.ResourceVersion, query.SelectFields(containers{object})[0]}, true
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	// Subscribers can ask for a subset of the events, we parse the expression before the upgrade so we can reject it with a 400
+	if err := applyView(r); err != nil {
+		log.Printf("eventsHandler: View error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filter *filterExpression
+	if where := r.URL.Query().Get("where"); where != "" {
+		var err error
+		if filter, err = parseFilterExpression(where); err != nil {
+			log.Printf("eventsHandler: Invalid where: %s error: %s", where, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	trackedWebsocket(func(ws *websocket.Conn) {
+		log.Printf("eventsHandler: Registering connection for %s\n", ws.Request().RemoteAddr)
+		client := &subscriber{
+			Connection: ws,
+			Filter:     filter,
+			Identity:   requestIdentity(r),
+		}
+		disconnectedChannel := eventDistr.Register(client)
+
+		// We never expect messages from the client, a read error means it has gone, which we would otherwise only notice when a send fails
+		// Filtered and scoped subscribers may not be sent anything for hours, so they would keep their socket reservation
+		go func() {
+			io.Copy(ioutil.Discard, ws)
+			eventDistr.Unregister(client)
+		}()
+
+		<-disconnectedChannel
+		log.Printf("eventsHandler: Closing for %s\n", ws.Request().RemoteAddr)
+	}).ServeHTTP(w, r)
+}
+
+func hostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/host" {
+		log.Printf("hostHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("hostHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireUnscoped(w, r, "hostHandler") {
+		return
+	}
+
+	var info, version map[string]interface{}
+	if err := getDaemonDocument(queryer, "info", &info); err != nil {
+		log.Printf("hostHandler: Get info error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := getDaemonDocument(queryer, "version", &version); err != nil {
+		log.Printf("hostHandler: Get version error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(prettyJSONData))
+	host := struct {
+		Info             map[string]interface{}
+		Version          map[string]interface{}
+		ClientAPIVersion string
+	}{
+		info,
+		version,
+		dockerAPIVersion,
+	}
+
+	// Browsers get the page, everything else gets the raw documents
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeJSON(w, "hostHandler", host)
+		return
+	}
+
+	if err := hostTemplate.Execute(w, host); err != nil {
+		log.Printf("hostHandler: Execute template error : %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
-func eventsHandler(ws *websocket.Conn) {
-	log.Printf("eventsHandler: Registering connection for %s\n", ws.Request().RemoteAddr)
-	disconnectedChannel := eventDistr.Register(ws)
-	<-disconnectedChannel
-	log.Printf("eventsHandler: Closing for %s\n", ws.Request().RemoteAddr)
+func diskUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/system/df" {
+		log.Printf("diskUsageHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("diskUsageHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireUnscoped(w, r, "diskUsageHandler") {
+		return
+	}
+
+	// Browsers get the page, which gets the figures using this handler
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		if err := diskUsageTemplate.Execute(w, nil); err != nil {
+			log.Printf("diskUsageHandler: Execute template error : %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			log.Printf("diskUsageHandler: Invalid limit: %s", value)
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usage, err := getDiskUsage(systemQueryer, queryer)
+	if err != nil {
+		log.Printf("diskUsageHandler: Get disk usage error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := usage.sortAndLimit(query.Get("sort"), limit); err != nil {
+		log.Printf("diskUsageHandler: Sort error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, "diskUsageHandler", usage)
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -116,10 +1036,14 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		ContainerPathPrefix string
 		ContainersPath      string
 		SocketPath          string
+		LogsPath            string
+		MetricsEnabled      bool
 	}{
 		"/containers/",
 		"/containers",
 		"/events",
+		"/logs",
+		metricsHist != nil,
 	}
 
 	err := rootTemplate.Execute(w, pageInfo)
@@ -129,3 +1053,125 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// resolveContainerPath resolves the container reference captured by pathRegexp to a full id
+// If it cannot be resolved the error response has been written and ok is false
+func resolveContainerPath(w http.ResponseWriter, r *http.Request, pathRegexp *regexp.Regexp, caller string) (string, bool) {
+	ref := pathRegexp.FindStringSubmatch(r.URL.Path)[1]
+
+	id, candidates, err := resolveContainerRef(queryer, ref, requestScope(r))
+	if err != nil {
+		log.Printf("%s: Resolve container error for ref: %s error: %s", caller, ref, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+
+	switch {
+	case id != "":
+		auditResolvedContainer(r, id)
+		return id, true
+	case len(candidates) == 0:
+		log.Printf("%s: Container not found for ref: %s", caller, ref)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	default:
+		log.Printf("%s: Ambiguous container ref: %s matches %d containers", caller, ref, len(candidates))
+		ambiguous := struct {
+			Message    string
+			Candidates []containerCandidate
+		}{
+			fmt.Sprintf("Ambiguous container reference %s, matches %d containers", ref, len(candidates)),
+			candidates,
+		}
+		data, _ := json.MarshalIndent(ambiguous, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(data)
+	}
+
+	return "", false
+}
+
+// checkNotModified sets the etag for the state generation, the generation must be read before querying the daemon
+// If the request's If-None-Match includes the etag we write a 304 and return true, the caller has nothing more to do
+func checkNotModified(w http.ResponseWriter, r *http.Request, generation int64, format string) bool {
+	etag := store.ETag(generation, representationVariant(r, format))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache") // Browsers can cache but must revalidate
+	w.Header().Add("Vary", "Authorization, Cookie")
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		// Weak comparison, W/ prefixes are ignored
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// representationVariant identifies how the generation is rendered for this request, the format, the query's fields, columns and path
+// and the caller, as policies and redaction differ by user and can change on a reload without the generation moving on
+func representationVariant(r *http.Request, format string) string {
+	user := ""
+	if id := requestIdentity(r); id != nil {
+		user = id.Name
+	}
+	// Encode sorts by key, so the same parameters in another order are the same representation
+	variant := strings.Join([]string{format, r.URL.Query().Encode(), user, strconv.FormatInt(currentSettings().LoadedAt.UnixNano(), 10)}, "\n")
+	hash := sha256.Sum256([]byte(variant))
+
+	return hex.EncodeToString(hash[:8])
+}
+
+func writeJSON(w http.ResponseWriter, caller string, data interface{}) {
+	prettyJSONData, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		log.Printf("%s: Convert to pretty json data error: %s", caller, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(prettyJSONData)
+}
+
+// writeRawValue writes scalars as plain text with no quoting, like jq -r, so scripts can use them directly
+// Objects and lists have no plain form so they are written as compact json
+func writeRawValue(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, cellText(value)+"\n")
+}
+
+func parseBoolParameter(value string, defaultValue bool) (bool, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid boolean: %s", value)
+	}
+
+	return result, nil
+}
+
+// parseTimeParameter accepts RFC3339, unix seconds or a duration relative to now such as -1h, empty gives the default
+func parseTimeParameter(value string, now, defaultValue time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time: %s, expected RFC3339, unix seconds or a relative duration such as -1h", value)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContainersWatchEndsWhenSettingsChangeWhatTheCallerSees(t *testing.T) {
+	defer withTestStore()()
+	policies := `{"Policies": [{"Users": ["alice"], "Selectors": ["team=payments"]}, {"Users": ["bob"], "Selectors": ["team=orders"]}]}`
+	defer withSettings(&settings{Policies: testPolicies(t, policies)})()
+	daemon := testEventDaemon()
+	store.Apply(daemon.query, event{"Type": "container", "Action": "start", "id": "web"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("user")
+		containersHandler(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, &identity{Name: name})))
+	}))
+	defer server.Close()
+	watch := func(name string) (*bufio.Scanner, func()) {
+		resp, err := http.Get(server.URL + "/containers?watch=1&user=" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bufio.NewScanner(resp.Body), func() { resp.Body.Close() }
+	}
+	next := func(scanner *bufio.Scanner) watchEvent {
+		if !scanner.Scan() {
+			t.Fatalf("Watch ended: %v", scanner.Err())
+		}
+		var event watchEvent
+		json.Unmarshal(scanner.Bytes(), &event)
+		return event
+	}
+
+	alice, closeAlice := watch("alice")
+	defer closeAlice()
+	bob, closeBob := watch("bob")
+	defer closeBob()
+	if event := next(alice); event.Type != changeAdded {
+		t.Fatalf("alice: got %#v, expected web ADDED", event)
+	}
+
+	// alice loses payments, bob's access is the same so his watch carries on
+	reloadSettings(&settings{Policies: testPolicies(t, `{"Policies": [{"Users": ["alice"], "Selectors": ["team=nobody"]}, {"Users": ["bob"], "Selectors": ["team=orders"]}]}`)})
+	store.Apply(daemon.query, event{"Type": "container", "Action": "start", "id": "db"})
+
+	if event := next(alice); event.Type != "ERROR" || event.Object.(map[string]interface{})["Code"] != float64(http.StatusGone) {
+		t.Errorf("alice: got %#v, expected an ERROR with a 410", event)
+	}
+	if alice.Scan() {
+		t.Errorf("alice: the watch carried on with %s", alice.Text())
+	}
+	if event := next(bob); event.Type != changeAdded || event.Object.(map[string]interface{})["Id"] != "db" {
+		t.Errorf("bob: got %#v, expected db ADDED", event)
+	}
+}
+
+func TestPsArgsRegexp(t *testing.T) {
+	tests := []struct {
+		PsArgs string
+		Valid  bool
+	}{
+		{"", true},
+		{"aux", true},
+		{"-eo pid,ppid,stat,args", true},
+		{"-o pid,%cpu,%mem,args", true},
+		{"-eo pid,args --sort=-%cpu,+pid", true},
+		{"-o pid=PID,comm=NAME", true},
+		// Nothing a shell, or the daemon's query string, would treat specially
+		{"aux; rm -rf /", false},
+		{"aux | sh", false},
+		{"$(id)", false},
+		{"aux&all=1", false},
+		{"-o pid\nargs", false},
+	}
+	for _, test := range tests {
+		if valid := psArgsRegexp.MatchString(test.PsArgs); valid != test.Valid {
+			t.Errorf("%q: got %v, expected %v", test.PsArgs, valid, test.Valid)
+		}
+	}
+}
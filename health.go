@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readinessPingTimeout = 5 * time.Second
+	readinessCacheTime   = 2 * time.Second
+)
+
+var readinessChecks = &readinessCache{}
+
+type readiness struct {
+	Ready                  bool
+	Reasons                []string // Shown to anyone as /readyz is unauthenticated, so without the daemon's errors
+	Details                []string `json:"-"` // The reasons with the errors, these are only logged
+	DaemonReachable        bool
+	EventsConnected        bool
+	EventsConnectedChanged time.Time
+	LastSync               time.Time
+}
+
+// checkReadiness is ready if the daemon responds, the event stream is connected and the state store has synced recently
+func checkReadiness(queryer dockerQueryer, staleThreshold time.Duration) *readiness {
+	result := &readiness{}
+	notReady := func(reason string, err error) {
+		result.Reasons = append(result.Reasons, reason)
+		if err != nil {
+			reason += fmt.Sprintf(": %s", err)
+		}
+		result.Details = append(result.Details, reason)
+	}
+
+	// A hung daemon should fail the check rather than hang it
+	ping := make(chan error, 1)
+	go func() { ping <- pingDaemon(queryer) }()
+	select {
+	case err := <-ping:
+		if err != nil {
+			notReady("Daemon is unreachable", err)
+		} else {
+			result.DaemonReachable = true
+		}
+	case <-time.After(readinessPingTimeout):
+		notReady(fmt.Sprintf("Daemon did not respond to a ping within %s", readinessPingTimeout), nil)
+	}
+
+	var lastError error
+	result.EventsConnected, result.EventsConnectedChanged, lastError = eventDistr.Status()
+	if !result.EventsConnected {
+		notReady(fmt.Sprintf("Event stream is disconnected since %s", result.EventsConnectedChanged.Format(time.RFC3339)), lastError)
+	}
+
+	result.LastSync = store.LastSynced()
+	if result.LastSync.IsZero() {
+		notReady("Container state has not been loaded yet", nil)
+	} else if age := time.Since(result.LastSync); age > staleThreshold {
+		notReady(fmt.Sprintf("Container state is stale, last synced %s ago", age.Truncate(time.Second)), nil)
+	}
+
+	result.Ready = len(result.Reasons) == 0
+	if result.Reasons == nil {
+		result.Reasons = []string{}
+	}
+
+	return result
+}
+
+// readinessCache keeps a check for readinessCacheTime, /readyz is unauthenticated and each check pings the daemon
+// Callers wait for a check that is in progress rather than start their own
+type readinessCache struct {
+	Mutex     sync.Mutex
+	Result    *readiness
+	CheckedAt time.Time
+}
+
+func (c *readinessCache) Get(check func() *readiness) *readiness {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if c.Result != nil && time.Since(c.CheckedAt) < readinessCacheTime {
+		return c.Result
+	}
+	c.Result, c.CheckedAt = check(), time.Now()
+	if !c.Result.Ready {
+		log.Printf("readinessCache.Get: Not ready: %s\n", strings.Join(c.Result.Details, ", "))
+	}
+
+	return c.Result
+}
+
+// healthzHandler only shows the process is alive and serving, use /readyz for the daemon and event stream
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/healthz" {
+		log.Printf("healthzHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/readyz" {
+		log.Printf("readyzHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("readyzHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	staleThreshold := currentSettings().StaleThreshold
+	result := readinessChecks.Get(func() *readiness { return checkReadiness(queryer, staleThreshold) })
+	if !result.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, "readyzHandler", result)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	defer withTestStore()()
+	defer withSettings(&settings{StaleThreshold: time.Minute})()
+	previousQueryer, previousDistributor, previousChecks := queryer, eventDistr, readinessChecks
+	defer func() { queryer, eventDistr, readinessChecks = previousQueryer, previousDistributor, previousChecks }()
+
+	var pings int32
+	queryer = func(url string) (*http.Response, error) {
+		atomic.AddInt32(&pings, 1)
+		return nil, errors.New("dial unix /var/run/docker.sock: connect: permission denied")
+	}
+	eventDistr = &eventDistributor{}
+	eventDistr.setConnected(false, errors.New("Events stream error: unexpected EOF from 10.0.0.5"))
+	readinessChecks = &readinessCache{}
+
+	readyz := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder
+	}
+
+	recorder := readyz()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d, expected %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	// The reasons say what is wrong, the daemon's errors are only logged
+	body := recorder.Body.String()
+	for _, expected := range []string{"Daemon is unreachable", "Event stream is disconnected", "Container state has not been loaded yet"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Got %s, expected it to include %q", body, expected)
+		}
+	}
+	for _, detail := range []string{"docker.sock", "10.0.0.5", "Details"} {
+		if strings.Contains(body, detail) {
+			t.Errorf("Got %s, expected no %q", body, detail)
+		}
+	}
+	if details := strings.Join(readinessChecks.Result.Details, ", "); !strings.Contains(details, "docker.sock") || !strings.Contains(details, "10.0.0.5") {
+		t.Errorf("Got details %s, expected the errors", details)
+	}
+
+	// Probes within the cache time get the same result without pinging the daemon
+	for index := 0; index < 5; index++ {
+		if recorder := readyz(); recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != body {
+			t.Errorf("Cached %d: got %d %s, expected the first result", index, recorder.Code, recorder.Body.String())
+		}
+	}
+	if count := atomic.LoadInt32(&pings); count != 1 {
+		t.Errorf("Got %d pings, expected 1", count)
+	}
+
+	// Once it has expired the daemon is checked again
+	readinessChecks.CheckedAt = time.Now().Add(-readinessCacheTime)
+	readyz()
+	if count := atomic.LoadInt32(&pings); count != 2 {
+		t.Errorf("After the cache time: got %d pings, expected 2", count)
+	}
+}
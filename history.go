@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tiers are ordered finest first, each raw sample is merged into every tier
+var metricsTiers = []metricsTierSpec{
+	{Resolution: 10 * time.Second, Retention: time.Hour},
+	{Resolution: 5 * time.Minute, Retention: 24 * time.Hour},
+}
+
+var (
+	metricsHist *metricsHistory
+)
+
+type metricsTierSpec struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+type metricsPoint struct {
+	Time        time.Time
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryPeak  uint64 // Highest usage seen within the point's bucket
+	MemoryLimit uint64
+	Samples     int // Number of raw samples merged into this point, used to keep averages correct when merging
+}
+
+// merge folds other into the point, averaging cpu and memory usage and keeping the peak memory usage
+func (p *metricsPoint) merge(other metricsPoint) {
+	total := p.Samples + other.Samples
+	if total == 0 {
+		return
+	}
+
+	p.CPUPercent = (p.CPUPercent*float64(p.Samples) + other.CPUPercent*float64(other.Samples)) / float64(total)
+	p.MemoryUsage = uint64((float64(p.MemoryUsage)*float64(p.Samples) + float64(other.MemoryUsage)*float64(other.Samples)) / float64(total))
+	if other.MemoryPeak > p.MemoryPeak {
+		p.MemoryPeak = other.MemoryPeak
+	}
+	if other.MemoryLimit != 0 {
+		p.MemoryLimit = other.MemoryLimit
+	}
+	p.Samples = total
+}
+
+type metricsTier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+	Points     []metricsPoint
+}
+
+func (t *metricsTier) add(point metricsPoint) {
+	bucket := point.Time.Truncate(t.Resolution)
+	if count := len(t.Points); count > 0 && t.Points[count-1].Time.Equal(bucket) {
+		t.Points[count-1].merge(point)
+	} else {
+		point.Time = bucket
+		t.Points = append(t.Points, point)
+	}
+
+	t.expire(point.Time)
+}
+
+func (t *metricsTier) expire(now time.Time) {
+	cutOff := now.Add(-t.Retention)
+	index := 0
+	for index < len(t.Points) && t.Points[index].Time.Before(cutOff) {
+		index++
+	}
+	t.Points = t.Points[index:]
+}
+
+type metricsSeries struct {
+	Tiers []*metricsTier
+}
+
+func newMetricsSeries() *metricsSeries {
+	series := &metricsSeries{}
+	for _, spec := range metricsTiers {
+		series.Tiers = append(series.Tiers, &metricsTier{Resolution: spec.Resolution, Retention: spec.Retention})
+	}
+
+	return series
+}
+
+type metricsHistory struct {
+	Mutex    sync.Mutex
+	FilePath string // Optional, if set the history is loaded from and saved to this file
+	Series   map[string]*metricsSeries
+}
+
+func newMetricsHistory(filePath string) *metricsHistory {
+	return &metricsHistory{
+		FilePath: filePath,
+		Series:   make(map[string]*metricsSeries),
+	}
+}
+
+func (h *metricsHistory) Add(id string, point metricsPoint) {
+	point.Samples = 1
+	point.MemoryPeak = point.MemoryUsage
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	series, ok := h.Series[id]
+	if !ok {
+		series = newMetricsSeries()
+		h.Series[id] = series
+	}
+	for _, tier := range series.Tiers {
+		tier.add(point)
+	}
+}
+
+// Expire drops points that have aged out, and series that no longer have any points, this covers containers that have been removed
+func (h *metricsHistory) Expire(now time.Time) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	for id, series := range h.Series {
+		empty := true
+		for _, tier := range series.Tiers {
+			tier.expire(now)
+			if len(tier.Points) > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			delete(h.Series, id)
+		}
+	}
+}
+
+// Query returns the points for the container between from and to, re-sampled to step
+// The finest tier that still covers from at now is used, step of zero means use the tier's resolution
+func (h *metricsHistory) Query(id string, from, to time.Time, step time.Duration, now time.Time) (bool, []metricsPoint) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	series, ok := h.Series[id]
+	if !ok {
+		return false, nil
+	}
+
+	tier := series.Tiers[len(series.Tiers)-1]
+	for _, candidate := range series.Tiers {
+		// Allow a bucket of slack so a from of exactly now - retention still uses the tier
+		if now.Sub(from) <= candidate.Retention+candidate.Resolution {
+			tier = candidate
+			break
+		}
+	}
+	if step < tier.Resolution {
+		step = tier.Resolution
+	}
+
+	points := make([]metricsPoint, 0)
+	for _, point := range tier.Points {
+		if point.Time.Before(from) || point.Time.After(to) {
+			continue
+		}
+
+		bucket := from.Add(point.Time.Sub(from) / step * step)
+		if count := len(points); count > 0 && points[count-1].Time.Equal(bucket) {
+			points[count-1].merge(point)
+			continue
+		}
+		point.Time = bucket
+		points = append(points, point)
+	}
+
+	return true, points
+}
+
+func (h *metricsHistory) Load() error {
+	if h.FilePath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(h.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Printf("metricsHistory.Load: Read file error for %s error: %s\n", h.FilePath, err)
+		return err
+	}
+
+	series := make(map[string]*metricsSeries)
+	if err := json.Unmarshal(data, &series); err != nil {
+		log.Printf("metricsHistory.Load: Unmarshal error for %s error: %s\n", h.FilePath, err)
+		return err
+	}
+
+	h.Mutex.Lock()
+	h.Series = series
+	h.Mutex.Unlock()
+	log.Printf("metricsHistory.Load: Loaded %d series from %s\n", len(series), h.FilePath)
+
+	return nil
+}
+
+func (h *metricsHistory) Save() error {
+	if h.FilePath == "" {
+		return nil
+	}
+
+	h.Mutex.Lock()
+	data, err := json.Marshal(h.Series)
+	h.Mutex.Unlock()
+	if err != nil {
+		log.Printf("metricsHistory.Save: Marshal error: %s\n", err)
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash mid write does not leave a truncated file
+	tempFilePath := h.FilePath + ".tmp"
+	if err := ioutil.WriteFile(tempFilePath, data, 0600); err != nil {
+		log.Printf("metricsHistory.Save: Write file error for %s error: %s\n", tempFilePath, err)
+		return err
+	}
+	if err := os.Rename(tempFilePath, h.FilePath); err != nil {
+		log.Printf("metricsHistory.Save: Rename error for %s error: %s\n", h.FilePath, err)
+		return err
+	}
+
+	return nil
+}
+
+// Latest returns the most recent point for the container if it is no older than maxAge, so stopped containers are not reported
+func (h *metricsHistory) Latest(id string, maxAge time.Duration) (metricsPoint, bool) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	series, ok := h.Series[id]
+	if !ok {
+		return metricsPoint{}, false
+	}
+	points := series.Tiers[0].Points
+	if len(points) == 0 || time.Since(points[len(points)-1].Time) > maxAge {
+		return metricsPoint{}, false
+	}
+
+	return points[len(points)-1], true
+}
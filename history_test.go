@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMetricsPointMerge(t *testing.T) {
+	point := metricsPoint{CPUPercent: 10, MemoryUsage: 100, MemoryPeak: 100, MemoryLimit: 500, Samples: 1}
+	point.merge(metricsPoint{CPUPercent: 40, MemoryUsage: 400, MemoryPeak: 700, MemoryLimit: 1000, Samples: 3})
+	expected := metricsPoint{CPUPercent: 32.5, MemoryUsage: 325, MemoryPeak: 700, MemoryLimit: 1000, Samples: 4}
+	if point != expected {
+		t.Errorf("Got %#v, expected %#v", point, expected)
+	}
+
+	// A point without a limit keeps the one we have, a lower peak does not replace ours
+	point.merge(metricsPoint{CPUPercent: 2.5, MemoryUsage: 25, MemoryPeak: 25, Samples: 1})
+	expected = metricsPoint{CPUPercent: 26.5, MemoryUsage: 265, MemoryPeak: 700, MemoryLimit: 1000, Samples: 5}
+	if point != expected {
+		t.Errorf("Got %#v, expected %#v", point, expected)
+	}
+
+	empty := metricsPoint{}
+	empty.merge(metricsPoint{})
+	if empty != (metricsPoint{}) {
+		t.Errorf("Empty: got %#v, expected nothing merged", empty)
+	}
+}
+
+func TestMetricsHistoryQuery(t *testing.T) {
+	// A sample every 10s for the last 2 hours, cpu and memory cycle each minute so every full minute averages the same
+	const mebibyte = 1 << 20
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	history := newMetricsHistory("")
+	for index := 0; index <= 720; index++ {
+		history.Add("web", metricsPoint{
+			Time:        now.Add(-2*time.Hour + time.Duration(index)*10*time.Second),
+			CPUPercent:  float64(index % 6),
+			MemoryUsage: uint64(index%6) * mebibyte,
+			MemoryLimit: 8 * mebibyte,
+		})
+	}
+
+	tests := []struct {
+		Name       string
+		From       time.Time
+		To         time.Time
+		Step       time.Duration
+		Count      int
+		Resolution time.Duration
+		Samples    int // Of the first point
+	}{
+		// Within the finest tier's hour we get 10s points
+		{"Last 30m", now.Add(-30 * time.Minute), now, 0, 181, 10 * time.Second, 1},
+		{"Last hour", now.Add(-time.Hour), now, 0, 361, 10 * time.Second, 1},
+		// A bucket of slack still uses the finest tier, after that it is 5m points
+		{"Last hour and a bucket", now.Add(-time.Hour - 10*time.Second), now, 0, 361, 10 * time.Second, 1},
+		{"Over the hour", now.Add(-time.Hour - 11*time.Second), now, 0, 13, 5 * time.Minute, 30},
+		{"Last 2 hours", now.Add(-2 * time.Hour), now, 0, 25, 5 * time.Minute, 30},
+		// Steps are re-sampled from the tier, a step finer than the tier is the tier's resolution
+		{"Last 30m by minute", now.Add(-30 * time.Minute), now, time.Minute, 31, time.Minute, 6},
+		{"Last 2 hours by second", now.Add(-2 * time.Hour), now, time.Second, 25, 5 * time.Minute, 30},
+		{"Last 2 hours by 30m", now.Add(-2 * time.Hour), now, 30 * time.Minute, 5, 30 * time.Minute, 180},
+		// To limits the points too
+		{"First 10m of the last 30m", now.Add(-30 * time.Minute), now.Add(-20 * time.Minute), 0, 61, 10 * time.Second, 1},
+		{"Future", now.Add(time.Minute), now.Add(time.Hour), 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		found, points := history.Query("web", test.From, test.To, test.Step, now)
+		if !found || len(points) != test.Count {
+			t.Errorf("%s: got found %v with %d points, expected %d", test.Name, found, len(points), test.Count)
+			continue
+		}
+		if test.Count == 0 {
+			continue
+		}
+		if points[0].Samples != test.Samples {
+			t.Errorf("%s: got %d samples in the first point, expected %d", test.Name, points[0].Samples, test.Samples)
+		}
+		// Buckets start at from, and there is a point in each as we have a sample every 10s
+		for index, point := range points {
+			if offset := point.Time.Sub(test.From); offset%test.Resolution != 0 || (index > 0 && point.Time.Sub(points[index-1].Time) != test.Resolution) {
+				t.Errorf("%s: got point %d at %s, expected every %s from %s", test.Name, index, point.Time, test.Resolution, test.From)
+				break
+			}
+		}
+		// Full buckets of a minute or more average the cycle, and keep its peak, memory is averaged in whole bytes so can be a few out
+		if test.Resolution >= time.Minute && (points[0].CPUPercent != 2.5 || math.Abs(float64(points[0].MemoryUsage)-2.5*mebibyte) > 1024 || points[0].MemoryPeak != 5*mebibyte || points[0].MemoryLimit != 8*mebibyte) {
+			t.Errorf("%s: got first point %#v, expected the averages of a cycle", test.Name, points[0])
+		}
+	}
+
+	// Which tier is used depends on the now we are given, not when the query runs
+	if _, points := history.Query("web", now.Add(-30*time.Minute), now, 0, now.Add(time.Hour)); len(points) != 7 {
+		t.Errorf("An hour later: got %d points, expected 7 from the 5m tier", len(points))
+	}
+
+	if found, points := history.Query("db", now.Add(-time.Hour), now, 0, now); found || len(points) != 0 {
+		t.Errorf("Unknown container: got found %v with %d points, expected none", found, len(points))
+	}
+}
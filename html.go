@@ -1,15 +1,68 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
+	"sort"
 )
 
 var (
-	rootTemplate *template.Template
+	rootTemplate      *template.Template
+	hostTemplate      *template.Template
+	diskUsageTemplate *template.Template
+	tableTemplate     *template.Template
+
+	templateFuncs = template.FuncMap{
+		"formatBytes": formatBytes,
+		"has":         has,
+		"keys":        keys,
+	}
 )
 
 func init() {
 	rootTemplate = template.Must(template.New("root").Parse(rootHTMLTemplate))
+	hostTemplate = template.Must(template.New("host").Funcs(templateFuncs).Parse(hostHTMLTemplate))
+	diskUsageTemplate = template.Must(template.New("diskUsage").Parse(diskUsageHTMLTemplate))
+	tableTemplate = template.Must(template.New("table").Parse(tableHTMLTemplate))
+}
+
+// formatBytes takes an interface as json numbers decode as float64
+func formatBytes(value interface{}) string {
+	bytes, ok := value.(float64)
+	if !ok {
+		return ""
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	index := 0
+	for bytes >= 1024 && index < len(units)-1 {
+		bytes /= 1024
+		index++
+	}
+	if index == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[index])
+	}
+
+	return fmt.Sprintf("%.1f %s", bytes, units[index])
+}
+
+// has lets templates tell a missing field from a zero value, fields come and go between api versions
+func has(value interface{}, key string) bool {
+	document, _ := value.(map[string]interface{})
+	_, ok := document[key]
+
+	return ok
+}
+
+func keys(value interface{}) []string {
+	document, _ := value.(map[string]interface{})
+	result := make([]string, 0, len(document))
+	for key := range document {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+
+	return result
 }
 
 // Could have used https://github.com/jteeuwen/go-bindata
@@ -26,16 +79,29 @@ const rootHTMLTemplate = `
             .status.running { color: green; }
             .status.paused  { color: yellow; }
             .status.stopped { color: red; }
+            .sparkline      { vertical-align: middle; stroke: steelblue; stroke-width: 1; fill: none; }
+            .sparkline.high { stroke: red; }
+            .name           { cursor: pointer; text-decoration: underline; }
+            .details        { display: none; margin-top: 20px; }
+            .logs           { background: #222; color: #ddd; height: 400px; overflow: auto; margin: 0; padding: 5px; font-family: monospace; white-space: pre-wrap; }
+            .logs .stderr   { border-left: 3px solid #c33; padding-left: 3px; }
+            .logs .tag      { font-weight: bold; }
+            .tree           { list-style: none; padding-left: 15px; margin: 0; font-family: monospace; }
+            .tree .added    { color: green; }
+            .tree .modified { color: darkorange; }
+            .tree .deleted  { color: red; text-decoration: line-through; }
         </style>
         <script type="text/javascript">
             var scheme = "http", wsScheme = "ws";
-            if (window.location.protocol == "https") {
+            if (window.location.protocol == "https:") {
                 scheme = "https"; wsScheme = "wss";
             }
 
             var containerUrlPrefix = scheme + "://" + window.location.host + "{{.ContainerPathPrefix}}";
             var containersUrl = scheme + "://" + window.location.host + "{{.ContainersPath}}";
             var eventsUrl = wsScheme + "://" + window.location.host + "{{.SocketPath}}";
+            var containerSocketUrlPrefix = wsScheme + "://" + window.location.host + "{{.ContainerPathPrefix}}";
+            var mergedLogsSocketUrl = wsScheme + "://" + window.location.host + "{{.LogsPath}}";
 
             var eventsSocket = null;
             var eventsSocketRetryIntervalInMilliseconds = 2000;
@@ -43,6 +109,18 @@ const rootHTMLTemplate = `
             var eventsSocketRetryAttempts = 0;
             var eventsSocketRetryAttempt = 0;
 
+            var metricsEnabled = {{.MetricsEnabled}};
+
+            var selectedContainerId = null;
+            var processesRefreshTimer = null;
+            var processesRefreshIntervalInMilliseconds = 5000;
+            var logsSocket = null;
+            var mergedLogsSocket = null;
+            var logTagColours = ["#6cf", "#fc6", "#6f6", "#f6c", "#c9f", "#9ff", "#fa8", "#8fa"];
+            var maxLogLines = 1000;
+            var ansiColours = ["black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"];
+            var ansiBrightColours = ["gray", "#f55", "#5f5", "#ff5", "#55f", "#f5f", "#5ff", "#fff"];
+
             function getContainerStatus(container) {
                 if (!container.State.Running) { return "stopped"; }
                 if (container.State.Paused) { return "paused"; }
@@ -58,6 +136,289 @@ const rootHTMLTemplate = `
                 return date.toLocaleTimeString(navigator.language, options);
             }
 
+            function formatBytes(bytes) {
+                var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+                var index = 0;
+                while (bytes >= 1024 && index < units.length - 1) { bytes /= 1024; index++; }
+                return bytes.toFixed(index == 0 ? 0 : 1) + " " + units[index];
+            }
+
+            function createSparkline(values, max, title, high) {
+                var width = 120, height = 20;
+                var svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+                svg.setAttribute("width", width);
+                svg.setAttribute("height", height);
+                svg.setAttribute("class", high ? "sparkline high" : "sparkline");
+
+                var titleElement = document.createElementNS("http://www.w3.org/2000/svg", "title");
+                titleElement.textContent = title;
+                svg.appendChild(titleElement);
+                if (values.length < 2 || max <= 0) { return svg; }
+
+                var points = "";
+                for (var index = 0; index < values.length; index++) {
+                    var x = index * (width - 1) / (values.length - 1);
+                    var y = height - 1 - (Math.min(values[index], max) * (height - 2) / max);
+                    points += x.toFixed(1) + "," + y.toFixed(1) + " ";
+                }
+                var polyline = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+                polyline.setAttribute("points", points);
+                svg.appendChild(polyline);
+
+                return svg;
+            }
+
+            function escapeHtml(text) {
+                return text.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+            }
+
+            function ansiToHtml(text) {
+                // Only SGR (colour and weight) sequences are rendered, any other escape sequences are dropped
+                var parts = text.split(/\x1b\[([0-9;]*)([A-Za-z])/);
+                var html = "", foreground = null, background = null, bold = false;
+                for (var index = 0; index < parts.length; index += 3) {
+                    if (index > 0 && parts[index - 1] == "m") {
+                        var codes = parts[index - 2] == "" ? [0] : parts[index - 2].split(";").map(Number);
+                        for (var codeIndex = 0; codeIndex < codes.length; codeIndex++) {
+                            var code = codes[codeIndex];
+                            if (code == 0) { foreground = null; background = null; bold = false; }
+                            else if (code == 1) { bold = true; }
+                            else if (code == 22) { bold = false; }
+                            else if (code >= 30 && code <= 37) { foreground = ansiColours[code - 30]; }
+                            else if (code == 39) { foreground = null; }
+                            else if (code >= 40 && code <= 47) { background = ansiColours[code - 40]; }
+                            else if (code == 49) { background = null; }
+                            else if (code >= 90 && code <= 97) { foreground = ansiBrightColours[code - 90]; }
+                            else if (code >= 100 && code <= 107) { background = ansiBrightColours[code - 100]; }
+                        }
+                    }
+
+                    if (parts[index] == "") { continue; }
+                    var style = "";
+                    if (foreground != null) { style += "color: " + foreground + ";"; }
+                    if (background != null) { style += "background-color: " + background + ";"; }
+                    if (bold) { style += "font-weight: bold;"; }
+                    var segment = escapeHtml(parts[index]);
+                    html += style == "" ? segment : "<span style=\"" + style + "\">" + segment + "</span>";
+                }
+
+                return html;
+            }
+
+            function showDetails(container) {
+                closeDetails();
+                selectedContainerId = container.Id;
+                document.getElementById("detailsName").textContent = container.Name.substring(1);
+                document.getElementById("details").style.display = "block";
+                populateProcesses();
+                populateChanges();
+                followLogs(container.Id);
+            }
+
+            function populateProcesses() {
+                if (selectedContainerId == null) { return; }
+
+                var processesElement = document.getElementById("processes");
+                var psArgs = document.getElementById("psArgs").value.trim();
+                var url = containerUrlPrefix + selectedContainerId + "/top";
+                if (psArgs != "") { url += "?ps_args=" + encodeURIComponent(psArgs); }
+
+                getData(url, function(top) {
+                    processesElement.innerHTML = "";
+                    var heading = document.createElement("div");
+                    heading.className = "heading";
+                    top.Titles.forEach(function(title) {
+                        var cell = document.createElement("div");
+                        cell.className = "cell";
+                        cell.textContent = title;
+                        heading.appendChild(cell);
+                    });
+                    processesElement.appendChild(heading);
+
+                    (top.Processes || []).forEach(function(process) {
+                        var row = document.createElement("div");
+                        row.className = "row";
+                        process.forEach(function(value) {
+                            var cell = document.createElement("div");
+                            cell.className = "cell";
+                            cell.textContent = value;
+                            row.appendChild(cell);
+                        });
+                        processesElement.appendChild(row);
+                    });
+                }, function(status) {
+                    // Stopped containers have no processes
+                    processesElement.textContent = "Processes not available (" + status + ")";
+                });
+            }
+
+            function populateChanges() {
+                if (selectedContainerId == null) { return; }
+
+                var changesElement = document.getElementById("changes");
+                var prefix = document.getElementById("changesPrefix").value.trim();
+                var url = containerUrlPrefix + selectedContainerId + "/changes";
+                if (prefix != "") { url += "?prefix=" + encodeURIComponent(prefix); }
+
+                getData(url, function(changes) {
+                    // Build a tree keyed by path segment, each node records its own change kind if it has one
+                    var root = { children: {} };
+                    [["Added", "added"], ["Modified", "modified"], ["Deleted", "deleted"]].forEach(function(group) {
+                        changes[group[0]].forEach(function(path) {
+                            var node = root;
+                            path.split("/").filter(function(segment) { return segment != ""; }).forEach(function(segment) {
+                                if (!node.children[segment]) { node.children[segment] = { children: {} }; }
+                                node = node.children[segment];
+                            });
+                            node.kind = group[1];
+                        });
+                    });
+
+                    changesElement.innerHTML = "";
+                    var counts = changes.Added.length + " added, " + changes.Modified.length + " modified, " + changes.Deleted.length + " deleted";
+                    changesElement.appendChild(document.createTextNode(counts));
+                    changesElement.appendChild(createChangesTree(root));
+                }, function(status) {
+                    changesElement.textContent = "Changes not available (" + status + ")";
+                });
+            }
+
+            function createChangesTree(node) {
+                var list = document.createElement("ul");
+                list.className = "tree";
+                Object.keys(node.children).sort().forEach(function(name) {
+                    var child = node.children[name];
+                    var item = document.createElement("li");
+                    var label = document.createElement("span");
+                    label.className = child.kind || "";
+                    label.textContent = name + (child.kind ? " (" + child.kind + ")" : "");
+
+                    if (Object.keys(child.children).length == 0) {
+                        item.appendChild(label);
+                    } else {
+                        var details = document.createElement("details");
+                        details.open = true;
+                        var summary = document.createElement("summary");
+                        summary.appendChild(label);
+                        details.appendChild(summary);
+                        details.appendChild(createChangesTree(child));
+                        item.appendChild(details);
+                    }
+                    list.appendChild(item);
+                });
+
+                return list;
+            }
+
+            function setProcessesAutoRefresh(enabled) {
+                if (processesRefreshTimer != null) {
+                    window.clearInterval(processesRefreshTimer);
+                    processesRefreshTimer = null;
+                }
+                if (enabled) { processesRefreshTimer = window.setInterval(populateProcesses, processesRefreshIntervalInMilliseconds); }
+            }
+
+            function closeDetails() {
+                selectedContainerId = null;
+                document.getElementById("processesAutoRefresh").checked = false;
+                setProcessesAutoRefresh(false);
+                document.getElementById("processes").innerHTML = "";
+                document.getElementById("changes").innerHTML = "";
+                if (logsSocket != null) {
+                    logsSocket.onmessage = null;
+                    logsSocket.close();
+                    logsSocket = null;
+                }
+                document.getElementById("logs").innerHTML = "";
+                document.getElementById("details").style.display = "none";
+            }
+
+            function followLogs(id) {
+                var logsElement = document.getElementById("logs");
+                logsSocket = new WebSocket(containerSocketUrlPrefix + id + "/logs?tail=200");
+                logsSocket.onmessage = function(e) { appendLogEntry(logsElement, JSON.parse(e.data)); }
+            }
+
+            function appendLogEntry(logsElement, entry) {
+                var line = document.createElement("div");
+                if (entry.Error) {
+                    line.className = "stderr";
+                    line.textContent = entry.Error;
+                } else {
+                    line.className = entry.Stream;
+                    line.title = entry.Time;
+                    line.innerHTML = ansiToHtml(entry.Text);
+                }
+
+                // Merged log entries are tagged with the container they came from
+                if (entry.ContainerName) {
+                    var tag = document.createElement("span");
+                    tag.className = "tag";
+                    tag.style.color = logTagColours[hashCode(entry.ContainerName) % logTagColours.length];
+                    tag.textContent = entry.ContainerName + " | ";
+                    line.insertBefore(tag, line.firstChild);
+                }
+
+                // Only keep scrolling if the user has not scrolled up to read something
+                var atBottom = logsElement.scrollTop + logsElement.clientHeight >= logsElement.scrollHeight - 5;
+                logsElement.appendChild(line);
+                while (logsElement.childElementCount > maxLogLines) {
+                    logsElement.removeChild(logsElement.firstElementChild);
+                }
+                if (atBottom) { logsElement.scrollTop = logsElement.scrollHeight; }
+            }
+
+            function hashCode(text) {
+                var hash = 0;
+                for (var index = 0; index < text.length; index++) { hash = (hash * 31 + text.charCodeAt(index)) & 0x7fffffff; }
+                return hash;
+            }
+
+            function followMergedLogs() {
+                stopMergedLogs();
+
+                var query = [];
+                ["containers", "label", "project"].forEach(function(name) {
+                    var value = document.getElementById("merged-" + name).value.trim();
+                    if (value != "") { query.push(name + "=" + encodeURIComponent(value)); }
+                });
+                if (query.length == 0) { return; }
+
+                var logsElement = document.getElementById("mergedLogs");
+                mergedLogsSocket = new WebSocket(mergedLogsSocketUrl + "?" + query.join("&"));
+                mergedLogsSocket.onmessage = function(e) { appendLogEntry(logsElement, JSON.parse(e.data)); }
+            }
+
+            function stopMergedLogs() {
+                if (mergedLogsSocket != null) {
+                    mergedLogsSocket.onmessage = null;
+                    mergedLogsSocket.close();
+                    mergedLogsSocket = null;
+                }
+                document.getElementById("mergedLogs").innerHTML = "";
+            }
+
+            function populateMetrics(row, id) {
+                getData(containerUrlPrefix + id + "/metrics?from=-1h", function(metrics) {
+                    var points = metrics.Points;
+                    if (points.length == 0) { return; }
+
+                    var cpu = points.map(function(point) { return point.CPUPercent; });
+                    var memory = points.map(function(point) { return point.MemoryPeak; });
+                    var last = points[points.length - 1];
+                    var maxCPU = Math.max(100, Math.max.apply(null, cpu));
+                    var maxMemory = Math.max.apply(null, memory);
+                    // Flag containers heading for their memory limit, this is what precedes an OOM kill
+                    var memoryHigh = last.MemoryLimit > 0 && last.MemoryPeak >= 0.9 * last.MemoryLimit;
+
+                    var cpuTitle = "Now " + last.CPUPercent.toFixed(1) + "% max " + Math.max.apply(null, cpu).toFixed(1) + "%";
+                    var memoryTitle = "Now " + formatBytes(last.MemoryUsage) + " peak " + formatBytes(maxMemory) + " limit " + formatBytes(last.MemoryLimit);
+                    row.querySelector(".cpu").appendChild(createSparkline(cpu, maxCPU, cpuTitle, false));
+                    row.querySelector(".memory").appendChild(createSparkline(memory, maxMemory, memoryTitle, memoryHigh));
+                    row.querySelector(".memory").appendChild(document.createTextNode(" " + formatBytes(last.MemoryUsage)));
+                }, console.log);
+            }
+
             function addContainer(container) {
                 var shortId = container.Id.substring(0, 12);
                 var name = container.Name.substring(1, container.Name.length -1); 
@@ -86,9 +447,11 @@ const rootHTMLTemplate = `
                 var containersElement = document.getElementById("containers");
                 var template = document.querySelector("#containerTemplate");
                 var content = document.importNode(template.content, true);
+                var row = content.querySelector(".row");
                 content.querySelector(".id").href = containerUrl;
                 content.querySelector(".id").textContent = shortId;
                 content.querySelector(".name").textContent = name;
+                content.querySelector(".name").onclick = function() { showDetails(container); };
                 content.querySelector(".pid").textContent = container.State.Pid;
                 content.querySelector(".pid").className += ' ' + status;
                 content.querySelector(".started").textContent = started;
@@ -99,6 +462,8 @@ const rootHTMLTemplate = `
                 content.querySelector(".volumes").innerHTML = volumes;
 
                 containersElement.appendChild(content);
+
+                if (metricsEnabled) { populateMetrics(row, container.Id); }
             }
 
             function setConnectionStatus(connected) {
@@ -191,6 +556,8 @@ const rootHTMLTemplate = `
         </script>
     </head>
     <body>
+        <a href="/host">Host</a>
+        <a href="/system/df">Disk usage</a>
         <div id="lastPopulation"></div>
         <div id="connectionStatus"></div>
         <h1>Containers</h1>
@@ -205,6 +572,8 @@ const rootHTMLTemplate = `
                 <div class="cell">Ports</div>
                 <div class="cell">Volumes From</div>
                 <div class="cell">Volumes</div>
+                {{if .MetricsEnabled}}<div class="cell">CPU (1h)</div>
+                <div class="cell">Memory (1h)</div>{{end}}
             </div>
         </div>
         <template id="containerTemplate">
@@ -218,8 +587,201 @@ const rootHTMLTemplate = `
                 <div class="cell ports"></div>
                 <div class="cell volumes-from"></div>
                 <div class="cell volumes"></div>
+                {{if .MetricsEnabled}}<div class="cell cpu"></div>
+                <div class="cell memory"></div>{{end}}
             </div>
         </template>
+        <div class="details" id="details">
+            <h2><span id="detailsName"></span> <button onclick="closeDetails()">Close</button></h2>
+            <h3>Processes</h3>
+            <div>
+                ps args <input type="text" id="psArgs" placeholder="aux"/>
+                <button onclick="populateProcesses()">Refresh</button>
+                <label><input type="checkbox" id="processesAutoRefresh" onchange="setProcessesAutoRefresh(this.checked)"/> Auto refresh</label>
+            </div>
+            <div class="table" id="processes"></div>
+            <h3>Filesystem changes</h3>
+            <div>
+                Path prefix <input type="text" id="changesPrefix" placeholder="/var/lib"/>
+                <button onclick="populateChanges()">Refresh</button>
+            </div>
+            <div id="changes"></div>
+            <h3>Logs</h3>
+            <pre class="logs" id="logs"></pre>
+        </div>
+        <h2>Merged logs</h2>
+        <div>
+            Containers <input type="text" id="merged-containers" placeholder="api,worker,proxy"/>
+            Label <input type="text" id="merged-label" placeholder="team=payments"/>
+            Project <input type="text" id="merged-project" placeholder="compose project"/>
+            <button onclick="followMergedLogs()">Follow</button>
+            <button onclick="stopMergedLogs()">Stop</button>
+        </div>
+        <pre class="logs" id="mergedLogs"></pre>
+    </body>
+</html>
+`
+
+const hostHTMLTemplate = `
+<html>
+    <head>
+        <title>Docker host</title>
+        <style type="text/css">
+            .table          { display: table; }
+            .row            { display: table-row; }
+            .cell           { display: table-cell; padding-left: 10px; padding-top: 5px; }
+            .label          { font-weight: bold; }
+            .warning        { color: darkorange; }
+        </style>
+    </head>
+    <body>
+        <a href="/">Containers</a>
+        <h1>Docker host {{.Info.Name}}</h1>
+        <div class="table">
+            <div class="row"><div class="cell label">Daemon version</div><div class="cell">{{.Version.Version}} (git commit {{.Version.GitCommit}}, {{.Version.GoVersion}})</div></div>
+            <div class="row"><div class="cell label">API version</div><div class="cell">{{.Version.ApiVersion}} (minimum {{.Version.MinAPIVersion}}, ddash uses {{.ClientAPIVersion}})</div></div>
+            <div class="row"><div class="cell label">Storage driver</div><div class="cell">{{.Info.Driver}}</div></div>
+            <div class="row"><div class="cell label">Cgroup driver</div><div class="cell">{{.Info.CgroupDriver}} {{.Info.CgroupVersion}}</div></div>
+            <div class="row"><div class="cell label">Logging driver</div><div class="cell">{{.Info.LoggingDriver}}</div></div>
+            <div class="row"><div class="cell label">Kernel</div><div class="cell">{{.Info.KernelVersion}}</div></div>
+            <div class="row"><div class="cell label">Operating system</div><div class="cell">{{.Info.OperatingSystem}} {{.Version.Os}}/{{.Version.Arch}}</div></div>
+            <div class="row"><div class="cell label">CPUs</div><div class="cell">{{.Info.NCPU}}</div></div>
+            <div class="row"><div class="cell label">Memory</div><div class="cell">{{formatBytes .Info.MemTotal}}</div></div>
+            <div class="row"><div class="cell label">Docker root dir</div><div class="cell">{{.Info.DockerRootDir}}</div></div>
+            <div class="row"><div class="cell label">Registry mirrors</div><div class="cell">{{with .Info.RegistryConfig}}{{range .Mirrors}}{{.}}<br/>{{end}}{{end}}</div></div>
+            <div class="row"><div class="cell label">Runtimes</div><div class="cell">{{range keys .Info.Runtimes}}{{.}} {{end}}{{with .Info.DefaultRuntime}}(default {{.}}){{end}}</div></div>
+            <div class="row"><div class="cell label">Containers</div><div class="cell">{{.Info.Containers}}{{if has .Info "ContainersRunning"}} ({{.Info.ContainersRunning}} running, {{.Info.ContainersPaused}} paused, {{.Info.ContainersStopped}} stopped){{end}}</div></div>
+            <div class="row"><div class="cell label">Images</div><div class="cell">{{.Info.Images}}</div></div>
+            <div class="row"><div class="cell label">Warnings</div><div class="cell warning">{{range .Info.Warnings}}{{.}}<br/>{{end}}</div></div>
+        </div>
+    </body>
+</html>
+`
+
+const diskUsageHTMLTemplate = `
+<html>
+    <head>
+        <title>Disk usage</title>
+        <style type="text/css">
+            .table          { display: table; }
+            .heading        { display: table-row; font-weight: bold; }
+            .heading .cell  { cursor: pointer; }
+            .row            { display: table-row; }
+            .cell           { display: table-cell; padding-left: 10px; padding-top: 5px; }
+            .number         { text-align: right; }
+            .reclaimable    { background-color: #fde8c8; }
+        </style>
+        <script type="text/javascript">
+            var categories = [["Images", "Images"], ["Containers", "Containers (writable layers)"], ["Volumes", "Volumes"], ["BuildCache", "Build cache"]];
+            var columns = [["Name", false], ["Id", false], ["Detail", false], ["Size", true], ["Reclaimable", true]];
+            var usage = null;
+            var sortColumn = "Size", sortDescending = true;
+
+            function formatBytes(bytes) {
+                var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+                var index = 0;
+                while (bytes >= 1024 && index < units.length - 1) { bytes /= 1024; index++; }
+                return bytes.toFixed(index == 0 ? 0 : 1) + " " + units[index];
+            }
+
+            function sortBy(column) {
+                sortDescending = column == sortColumn ? !sortDescending : (column == "Size" || column == "Reclaimable");
+                sortColumn = column;
+                render();
+            }
+
+            function render() {
+                var element = document.getElementById("usage");
+                element.innerHTML = "";
+                document.getElementById("source").textContent = "Source: " + usage.Source;
+
+                categories.forEach(function(category) {
+                    var data = usage[category[0]];
+                    var heading = document.createElement("h2");
+                    heading.textContent = category[1] + ": " + data.Count + " (" + data.Active + " active) using " + formatBytes(data.Size) + ", " + formatBytes(data.Reclaimable) + " reclaimable";
+                    if (data.Reclaimable > 0) { heading.className = "reclaimable"; }
+                    element.appendChild(heading);
+
+                    var table = document.createElement("div");
+                    table.className = "table";
+                    var headingRow = document.createElement("div");
+                    headingRow.className = "heading";
+                    columns.forEach(function(column) {
+                        var cell = document.createElement("div");
+                        cell.className = column[1] ? "cell number" : "cell";
+                        cell.textContent = column[0] + (column[0] == sortColumn ? (sortDescending ? " \u25bc" : " \u25b2") : "");
+                        cell.onclick = function() { sortBy(column[0]); };
+                        headingRow.appendChild(cell);
+                    });
+                    table.appendChild(headingRow);
+
+                    var items = data.Items.slice();
+                    items.sort(function(a, b) {
+                        var result = a[sortColumn] < b[sortColumn] ? -1 : (a[sortColumn] > b[sortColumn] ? 1 : 0);
+                        return sortDescending ? -result : result;
+                    });
+                    items.forEach(function(item) {
+                        var row = document.createElement("div");
+                        row.className = item.Reclaimable > 0 ? "row reclaimable" : "row";
+                        columns.forEach(function(column) {
+                            var cell = document.createElement("div");
+                            cell.className = column[1] ? "cell number" : "cell";
+                            var value = item[column[0]];
+                            if (column[0] == "Id") { value = value.replace("sha256:", "").substring(0, 12); }
+                            cell.textContent = column[1] ? formatBytes(value) : value;
+                            row.appendChild(cell);
+                        });
+                        table.appendChild(row);
+                    });
+                    element.appendChild(table);
+                });
+            }
+
+            window.onload = function() {
+                var xhr = new XMLHttpRequest();
+                xhr.onreadystatechange = function() {
+                    if (xhr.readyState == 4) {
+                        if (xhr.status == 200) {
+                            usage = JSON.parse(xhr.response);
+                            render();
+                        } else {
+                            document.getElementById("usage").textContent = "Failed to get disk usage: " + xhr.status + " " + xhr.response;
+                        }
+                    }
+                };
+                xhr.open("GET", window.location.pathname);
+                xhr.setRequestHeader('Accept', 'application/json');
+                xhr.send();
+            }
+        </script>
+    </head>
+    <body>
+        <a href="/">Containers</a>
+        <h1>Disk usage</h1>
+        <div id="source"></div>
+        <div id="usage"></div>
+    </body>
+</html>
+`
+
+const tableHTMLTemplate = `
+<html>
+    <head>
+        <title>{{.Title}}</title>
+        <style type="text/css">
+            table           { border-collapse: collapse; }
+            th, td          { padding: 5px 10px; text-align: left; vertical-align: top; border-bottom: 1px solid lightgray; }
+            th              { font-weight: bold; }
+        </style>
+    </head>
+    <body>
+        <a href="/">Containers</a>
+        <h1>{{.Title}}</h1>
+        <table>
+            <tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+            {{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+            {{end}}
+        </table>
     </body>
 </html>
 `
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimiterSweepInterval = time.Minute
+
+var (
+	requestLimiter     = newRateLimiter(0, 0) // Unlimited until the settings are applied, the rate can change on a config reload
+	authFailureLimiter = newRateLimiter(0, 0) // Failed logins by address, separate so guessing is limited even if requests are not
+)
+
+// checkWebsocketOrigin is checked before the upgrade so a browser page from another site can not use the caller's credentials
+func checkWebsocketOrigin(r *http.Request) error {
+	value := r.Header.Get("Origin")
+	if value == "" {
+		return fmt.Errorf("Missing origin")
+	}
+	origin, err := url.ParseRequestURI(value)
+	if err != nil {
+		return fmt.Errorf("Invalid origin: %s", value)
+	}
+
+	allowedOrigins := currentSettings().AllowedOrigins
+	if len(allowedOrigins) == 0 {
+		if strings.EqualFold(origin.Host, r.Host) {
+			return nil
+		}
+		return fmt.Errorf("Origin %s is not the same as the host %s", value, r.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Origin %s is not allowed", value)
+}
+
+// clientKey identifies the caller for limits, the user if authenticated otherwise the address
+func clientKey(r *http.Request) string {
+	if id := requestIdentity(r); id != nil {
+		return "user:" + id.Name
+	}
+
+	return "address:" + clientAddress(r)
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return host
+}
+
+// tokenBucket allows Burst requests at once, refilling at the limiter's rate
+type tokenBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	Mutex     sync.Mutex
+	Rate      float64 // Requests per second, zero is unlimited
+	Burst     float64
+	Buckets   map[string]*tokenBucket
+	LastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	limiter := &rateLimiter{LastSweep: time.Now()}
+	limiter.SetRate(rate, burst)
+
+	return limiter
+}
+
+// SetRate changes the limit, clients start again with a full bucket if it changed
+func (l *rateLimiter) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if l.Buckets != nil && l.Rate == rate && l.Burst == float64(burst) {
+		return
+	}
+	l.Rate, l.Burst = rate, float64(burst)
+	l.Buckets = make(map[string]*tokenBucket)
+}
+
+// Allow takes a token for the client, if there is none it returns how long until there will be
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if l.Rate <= 0 {
+		return true, 0
+	}
+
+	// Full buckets are the same as no bucket, so we drop them rather than keep one for every client we have ever seen
+	if now.Sub(l.LastSweep) > rateLimiterSweepInterval {
+		for bucketKey, bucket := range l.Buckets {
+			if bucket.Tokens+now.Sub(bucket.Updated).Seconds()*l.Rate >= l.Burst {
+				delete(l.Buckets, bucketKey)
+			}
+		}
+		l.LastSweep = now
+	}
+
+	bucket, ok := l.Buckets[key]
+	if !ok {
+		bucket = &tokenBucket{Tokens: l.Burst, Updated: now}
+		l.Buckets[key] = bucket
+	}
+	bucket.Tokens = math.Min(l.Burst, bucket.Tokens+now.Sub(bucket.Updated).Seconds()*l.Rate)
+	bucket.Updated = now
+	if bucket.Tokens < 1 {
+		return false, time.Duration((1 - bucket.Tokens) / l.Rate * float64(time.Second))
+	}
+	bucket.Tokens--
+
+	return true, 0
+}
+
+// Wait returns how long until the client has a token without taking one, zero if it has one now
+func (l *rateLimiter) Wait(key string, now time.Time) time.Duration {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	bucket, ok := l.Buckets[key]
+	if l.Rate <= 0 || !ok {
+		return 0
+	}
+
+	if tokens := math.Min(l.Burst, bucket.Tokens+now.Sub(bucket.Updated).Seconds()*l.Rate); tokens < 1 {
+		return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+	}
+
+	return 0
+}
+
+// rateLimitHandler responds with a 429 once a client has used its burst, it goes inside authentication so users are limited rather than addresses
+func rateLimitHandler(handler http.Handler, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientKey(r)
+		if ok, wait := limiter.Allow(key, time.Now()); !ok {
+			log.Printf("rateLimitHandler: Rate limited %s for %s", key, r.URL.Path)
+			tooManyRequests(w, wait)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authFailureLimitHandler goes outside authentication, each 401 takes one of the address's tokens so guessing credentials is limited
+// Once the address has no tokens left its requests get a 429 before their credentials are checked, successful requests take nothing here
+func authFailureLimitHandler(handler http.Handler, limiter *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "failures:" + clientAddress(r)
+		if wait := limiter.Wait(key, time.Now()); wait > 0 {
+			log.Printf("authFailureLimitHandler: Rate limited %s for %s", key, r.URL.Path)
+			tooManyRequests(w, wait)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.Status == http.StatusUnauthorized {
+			limiter.Allow(key, time.Now())
+		}
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestAuthFailureLimitHandler(t *testing.T) {
+	limiter := newRateLimiter(0.001, 2)
+	handler := authFailureLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer right" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+	}), limiter)
+	request := func(address, token string) int {
+		r := httptest.NewRequest("GET", "/containers", nil)
+		r.RemoteAddr = address + ":1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	// Successful requests take nothing
+	for index := 0; index < 5; index++ {
+		if code := request("10.0.0.1", "right"); code != http.StatusOK {
+			t.Fatalf("Request %d: got %d, expected %d", index, code, http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		Address  string
+		Token    string
+		Expected int
+	}{
+		{"10.0.0.1", "wrong", http.StatusUnauthorized},
+		{"10.0.0.1", "wrong", http.StatusUnauthorized},
+		// The burst is used up, so the credentials are not checked, even if they are right
+		{"10.0.0.1", "wrong", http.StatusTooManyRequests},
+		{"10.0.0.1", "right", http.StatusTooManyRequests},
+		// Other addresses have their own tokens
+		{"10.0.0.2", "wrong", http.StatusUnauthorized},
+		{"10.0.0.2", "right", http.StatusOK},
+	}
+	for index, test := range tests {
+		if code := request(test.Address, test.Token); code != test.Expected {
+			t.Errorf("%d %s: got %d, expected %d", index, test.Address, code, test.Expected)
+		}
+	}
+
+	// No rate is no limit
+	limiter.SetRate(0, 0)
+	if code := request("10.0.0.1", "right"); code != http.StatusOK {
+		t.Errorf("Without a rate: got %d, expected %d", code, http.StatusOK)
+	}
+}
+
+func TestAuthFailuresAreLimitedByDefault(t *testing.T) {
+	// The request limit is off by default, failed logins are limited anyway
+	defaults, err := newSettings(configValues(&configFile{}), &configFile{}, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if defaults.RateLimit != 0 || defaults.AuthFailureLimit <= 0 || defaults.AuthFailureBurst <= 0 {
+		t.Errorf("Got rate %v, failures %v with burst %d, expected only failures limited", defaults.RateLimit, defaults.AuthFailureLimit, defaults.AuthFailureBurst)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Now()
+	limiter := newRateLimiter(2, 3)
+	tests := []struct {
+		Name    string
+		Key     string
+		After   time.Duration
+		Allowed bool
+		Wait    time.Duration
+	}{
+		// The burst is allowed at once
+		{"Burst 1", "a", 0, true, 0},
+		{"Burst 2", "a", 0, true, 0},
+		{"Burst 3", "a", 0, true, 0},
+		{"Empty", "a", 0, false, 500 * time.Millisecond},
+		{"Other client", "b", 0, true, 0},
+		// Tokens refill at 2 a second
+		{"Part refilled", "a", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"Refilled", "a", 500 * time.Millisecond, true, 0},
+		{"Empty again", "a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		// The refill stops at the burst
+		{"Full 1", "a", time.Hour, true, 0},
+		{"Full 2", "a", time.Hour, true, 0},
+		{"Full 3", "a", time.Hour, true, 0},
+		{"Full then empty", "a", time.Hour, false, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if allowed, wait := limiter.Allow(test.Key, start.Add(test.After)); allowed != test.Allowed || wait != test.Wait {
+			t.Errorf("%s: got %v waiting %s, expected %v waiting %s", test.Name, allowed, wait, test.Allowed, test.Wait)
+		}
+	}
+
+	// Full buckets are dropped once the sweep interval has passed, the ones still refilling are kept
+	limiter = newRateLimiter(0.001, 2)
+	limiter.LastSweep = start
+	limiter.Allow("full", start)
+	limiter.Allow("empty", start)
+	limiter.Allow("empty", start)
+	later := start.Add(rateLimiterSweepInterval + time.Second)
+	limiter.Buckets["full"].Tokens = limiter.Burst
+	limiter.Allow("other", later)
+	if _, ok := limiter.Buckets["full"]; ok {
+		t.Errorf("Got a bucket for full, expected it swept")
+	}
+	if _, ok := limiter.Buckets["empty"]; !ok {
+		t.Errorf("Got no bucket for empty, expected it kept as it is still refilling")
+	}
+	if !limiter.LastSweep.Equal(later) {
+		t.Errorf("Got last sweep %s, expected %s", limiter.LastSweep, later)
+	}
+
+	// No rate is no limit
+	limiter.SetRate(0, 0)
+	for index := 0; index < 10; index++ {
+		if allowed, _ := limiter.Allow("empty", later); !allowed {
+			t.Fatalf("Without a rate %d: got not allowed", index)
+		}
+	}
+}
+
+func TestSocketRegistryLimits(t *testing.T) {
+	registry := &socketRegistry{Sockets: make(map[*websocket.Conn]bool), Clients: make(map[string]int)}
+	registry.SetLimits(3, 2)
+
+	tests := []struct {
+		Key     string
+		Release bool
+		Allowed bool
+	}{
+		{"user:alice", false, true},
+		{"user:alice", false, true},
+		// alice is at the per client limit, others are not
+		{"user:alice", false, false},
+		{"user:bob", false, true},
+		// At the overall limit, even for a new client
+		{"user:carol", false, false},
+		// Releasing one of alice's makes room for her or anyone else
+		{"user:alice", true, true},
+		{"user:carol", false, true},
+		{"user:alice", false, false},
+		{"user:bob", true, true},
+		{"user:alice", false, true},
+	}
+	for index, test := range tests {
+		if test.Release {
+			registry.Release(test.Key)
+			continue
+		}
+		if err := registry.Reserve(test.Key); (err == nil) != test.Allowed {
+			t.Errorf("%d %s: got %v, expected allowed %v", index, test.Key, err, test.Allowed)
+		}
+	}
+	if registry.Reserved != 3 || registry.Clients["user:alice"] != 2 || registry.Clients["user:carol"] != 1 {
+		t.Errorf("Got %d reserved for %v, expected 3", registry.Reserved, registry.Clients)
+	}
+
+	// Released clients are not kept
+	registry.Release("user:carol")
+	if _, ok := registry.Clients["user:carol"]; ok {
+		t.Errorf("Got %v, expected carol removed", registry.Clients)
+	}
+
+	// Zero is unlimited
+	registry.SetLimits(0, 0)
+	for index := 0; index < 10; index++ {
+		if err := registry.Reserve("user:alice"); err != nil {
+			t.Fatalf("Unlimited %d: got %s", index, err)
+		}
+	}
+}
+
+func TestCheckWebsocketOrigin(t *testing.T) {
+	defer withSettings(&settings{})()
+	tests := []struct {
+		Allowed []string
+		Host    string
+		Origin  string
+		Valid   bool
+	}{
+		// Without allowed origins only the page's own host is allowed, whatever the scheme
+		{nil, "ddash.example.com", "https://ddash.example.com", true},
+		{nil, "ddash.example.com:8090", "http://DDASH.example.com:8090", true},
+		{nil, "ddash.example.com", "https://evil.example.com", false},
+		{nil, "ddash.example.com:8090", "http://ddash.example.com", false},
+		{nil, "ddash.example.com", "", false},
+		{nil, "ddash.example.com", "null", false},
+		// Allowed origins replace the host check, scheme and host have to match
+		{[]string{"https://ddash.example.com"}, "internal:8090", "https://ddash.example.com", true},
+		{[]string{"https://ddash.example.com"}, "internal:8090", "http://ddash.example.com", false},
+		{[]string{"https://ddash.example.com"}, "ddash.example.com", "https://ddash.example.com.evil.com", false},
+		{[]string{"https://a.example.com", "https://b.example.com"}, "internal", "https://B.example.com", true},
+		{[]string{"*"}, "internal", "https://anywhere.example.com", true},
+		{[]string{"*"}, "internal", "", false},
+	}
+	for _, test := range tests {
+		reloadSettings(&settings{AllowedOrigins: test.Allowed})
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Host = test.Host
+		if test.Origin != "" {
+			r.Header.Set("Origin", test.Origin)
+		}
+		if err := checkWebsocketOrigin(r); (err == nil) != test.Valid {
+			t.Errorf("%v %s from %q: got %v, expected valid %v", test.Allowed, test.Host, test.Origin, err, test.Valid)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logEntry struct {
+	Stream string
+	Time   time.Time
+	Text   string
+}
+
+type logOptions struct {
+	Tail       string // "all" or a line count, applied by the daemon
+	Since      time.Time
+	Until      time.Time
+	Stdout     bool
+	Stderr     bool
+	Timestamps bool // Only affects how entries are rendered, we always ask the daemon for timestamps so we can filter on since and until
+	Follow     bool
+}
+
+func parseLogOptions(query url.Values, now time.Time) (*logOptions, error) {
+	options := &logOptions{Tail: "all"}
+
+	if value := query.Get("tail"); value != "" && value != "all" {
+		if lines, err := strconv.Atoi(value); err != nil || lines < 0 {
+			return nil, fmt.Errorf("Invalid tail: %s, expected all or a line count", value)
+		}
+		options.Tail = value
+	}
+
+	var err error
+	if options.Since, err = parseTimeParameter(query.Get("since"), now, time.Time{}); err != nil {
+		return nil, err
+	}
+	if options.Until, err = parseTimeParameter(query.Get("until"), now, time.Time{}); err != nil {
+		return nil, err
+	}
+
+	// If neither stream is specified we include both
+	defaultStream := query.Get("stdout") == "" && query.Get("stderr") == ""
+	if options.Stdout, err = parseBoolParameter(query.Get("stdout"), defaultStream); err != nil {
+		return nil, err
+	}
+	if options.Stderr, err = parseBoolParameter(query.Get("stderr"), defaultStream); err != nil {
+		return nil, err
+	}
+	if !options.Stdout && !options.Stderr {
+		return nil, fmt.Errorf("At least one of stdout or stderr is required")
+	}
+
+	if options.Timestamps, err = parseBoolParameter(query.Get("timestamps"), false); err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// includes applies the since and until filter, the daemon only supports these on newer api versions
+func (o *logOptions) includes(entry logEntry) bool {
+	if !o.Since.IsZero() && entry.Time.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && entry.Time.After(o.Until) {
+		return false
+	}
+
+	return true
+}
+
+func (o *logOptions) render(entry logEntry) string {
+	if o.Timestamps {
+		return entry.Time.Format(time.RFC3339Nano) + " " + entry.Text + "\n"
+	}
+
+	return entry.Text + "\n"
+}
+
+// readLogEntries reads a docker logs stream calling emit for each complete line, stopping at the first emit error
+// Non tty containers have their stdout and stderr multiplexed, each frame has an 8 byte header
+//
+//	[stream type, 0, 0, 0, size (4 bytes big endian)] where stream type is 0 stdin, 1 stdout and 2 stderr
+//
+// Tty containers have a single raw stream
+func readLogEntries(reader io.Reader, tty bool, emit func(logEntry) error) error {
+	if tty {
+		return readLogLines(reader, "stdout", emit)
+	}
+
+	var partialLines [3]bytes.Buffer
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+
+		streamType := header[0]
+		if streamType > 2 {
+			return fmt.Errorf("Unexpected log stream type: %d", streamType)
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+
+		// Frames do not have to align with lines, so we only emit complete lines and keep the remainder
+		// The frame is copied in chunks so a frame or line with no newline can not make the buffer grow without bound
+		buffer := &partialLines[streamType]
+		for remaining := int64(size); remaining > 0; {
+			chunk := remaining
+			if chunk > maxLogLineSize {
+				chunk = maxLogLineSize
+			}
+			copied, err := io.CopyN(buffer, reader, chunk)
+			remaining -= copied
+			if emitErr := emitLogLines(buffer, logStreamNames[streamType], emit); emitErr != nil {
+				return emitErr
+			}
+			if err != nil {
+				if err == io.EOF {
+					// The stream ended part way through the frame, the header read reports the end
+					break
+				}
+				return err
+			}
+		}
+	}
+
+	for streamType := range partialLines {
+		if partialLines[streamType].Len() > 0 {
+			if err := emit(parseLogLine(logStreamNames[streamType], partialLines[streamType].String())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Lines longer than this are split, so output with no newlines can not use up the memory
+const maxLogLineSize = 64 * 1024
+
+var logStreamNames = [3]string{"stdin", "stdout", "stderr"}
+
+// emitLogLines emits the complete lines in the buffer, if what is left is a full line's worth it is emitted as a line of its own
+func emitLogLines(buffer *bytes.Buffer, stream string, emit func(logEntry) error) error {
+	for {
+		index := bytes.IndexByte(buffer.Bytes(), '\n')
+		if index < 0 {
+			break
+		}
+		if err := emit(parseLogLine(stream, string(buffer.Next(index+1)))); err != nil {
+			return err
+		}
+	}
+	if buffer.Len() >= maxLogLineSize {
+		line := buffer.String()
+		buffer.Reset()
+		return emit(parseLogLine(stream, line))
+	}
+
+	return nil
+}
+
+func readLogLines(reader io.Reader, stream string, emit func(logEntry) error) error {
+	bufferedReader := bufio.NewReaderSize(reader, maxLogLineSize)
+	for {
+		// A full buffer is returned as a line of its own
+		line, err := bufferedReader.ReadSlice('\n')
+		if len(line) > 0 {
+			if emitErr := emit(parseLogLine(stream, string(line))); emitErr != nil {
+				return emitErr
+			}
+		}
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// parseLogLine splits off the timestamp the daemon prefixes each line with when asked for timestamps
+func parseLogLine(stream, line string) logEntry {
+	line = strings.TrimRight(line, "\r\n")
+	entry := logEntry{Stream: stream, Text: line}
+
+	if index := strings.IndexByte(line, ' '); index > 0 {
+		if timestamp, err := time.Parse(time.RFC3339Nano, line[:index]); err == nil {
+			entry.Time = timestamp
+			entry.Text = line[index+1:]
+		}
+	}
+
+	return entry
+}
+
+func isTtyContainer(container container) bool {
+	config, _ := container["Config"].(map[string]interface{})
+	tty, _ := config["Tty"].(bool)
+
+	return tty
+}
+
+type taggedLogEntry struct {
+	ContainerID   string `json:"ContainerId"`
+	ContainerName string
+	logEntry
+}
+
+// readContainerLogs reads the logs for the container, tagging each entry that passes the options filter with the container's id and name
+// Closing stop closes the logs, which ends a read blocked on an idle follow stream, stop and counter can be nil
+func readContainerLogs(queryer dockerQueryer, container container, options *logOptions, stop <-chan struct{}, counter *logByteCounter, emit func(taggedLogEntry) error) error {
+	id := containerID(container)
+	name := containerName(container)
+
+	found, logs, err := getContainerLogs(queryer, id, options)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Container not found for id: %s", id)
+	}
+	defer logs.Close()
+	if stop != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stop:
+				logs.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	var reader io.Reader = logs
+	if counter != nil {
+		reader = &countedReader{Reader: logs, Counter: counter}
+	}
+
+	return readLogEntries(reader, isTtyContainer(container), func(entry logEntry) error {
+		if !options.includes(entry) {
+			return nil
+		}
+		return emit(taggedLogEntry{ContainerID: id, ContainerName: name, logEntry: entry})
+	})
+}
+
+// getMergedLogs reads the logs for all the containers concurrently and returns them interleaved by time
+func getMergedLogs(queryer dockerQueryer, containers containers, options *logOptions) ([]taggedLogEntry, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var entries []taggedLogEntry
+	var firstErr error
+	for _, selected := range containers {
+		wg.Add(1)
+		go func(container container) {
+			defer wg.Done()
+
+			var containerEntries []taggedLogEntry
+			err := readContainerLogs(queryer, container, options, nil, nil, func(entry taggedLogEntry) error {
+				containerEntries = append(containerEntries, entry)
+				return nil
+			})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			entries = append(entries, containerEntries...)
+		}(selected)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sortLogEntries(entries)
+	return entries, nil
+}
+
+// followMergedLogs follows the logs for all the containers until stop is closed or all the streams end
+// Entries are buffered and sorted by time before being emitted, so lines arriving close together are interleaved by time
+func followMergedLogs(queryer dockerQueryer, containers containers, options *logOptions, stop <-chan struct{}, emit func(taggedLogEntry) error) error {
+	incomming := make(chan taggedLogEntry)
+	streamsDone := make(chan struct{})
+	// Closed however we return, so the readers close their streams rather than stay blocked on them
+	returned := make(chan struct{})
+	defer close(returned)
+
+	var wg sync.WaitGroup
+	for _, selected := range containers {
+		wg.Add(1)
+		go func(container container) {
+			defer wg.Done()
+
+			err := readContainerLogs(queryer, container, options, returned, nil, func(entry taggedLogEntry) error {
+				select {
+				case incomming <- entry:
+					return nil
+				case <-returned:
+					return errStopped
+				}
+			})
+			select {
+			case <-returned:
+				// The stream was closed as we returned, so the read error is expected
+			default:
+				if err != nil && err != errStopped {
+					log.Printf("followMergedLogs: Read logs error for id: %s error: %s\n", containerID(container), err)
+				}
+			}
+		}(selected)
+	}
+	go func() {
+		wg.Wait()
+		close(streamsDone)
+	}()
+
+	ticker := time.NewTicker(mergedLogsFlushInterval)
+	defer ticker.Stop()
+
+	// Entries are held until they are older than the flush interval, so a line that is a little late arriving from one stream is still emitted in order
+	var buffer []taggedLogEntry
+	flush := func(all bool) error {
+		sortLogEntries(buffer)
+		watermark := time.Now().Add(-mergedLogsFlushInterval)
+		count := 0
+		for _, entry := range buffer {
+			if !all && entry.Time.After(watermark) {
+				break
+			}
+			if err := emit(entry); err != nil {
+				return err
+			}
+			count++
+		}
+		buffer = append(buffer[:0], buffer[count:]...)
+		return nil
+	}
+
+	for {
+		select {
+		case entry := <-incomming:
+			buffer = append(buffer, entry)
+		case <-ticker.C:
+			if err := flush(false); err != nil {
+				return err
+			}
+		case <-streamsDone:
+			return flush(true)
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+const (
+	defaultMergedLogsTail   = "100"
+	maxMergedLogsContainers = 20
+	mergedLogsFlushInterval = 250 * time.Millisecond
+)
+
+var errStopped = errors.New("Stopped")
+
+func sortLogEntries(entries []taggedLogEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
+
+// renderTagged renders a line the way docker-compose does, with the container name as a prefix
+func (o *logOptions) renderTagged(entry taggedLogEntry, nameWidth int) string {
+	return fmt.Sprintf("%-*s | %s", nameWidth, entry.ContainerName, o.render(entry.logEntry))
+}
+
+const (
+	defaultLogSearchMaxBytes   = 64 << 20
+	maxLogSearchMaxBytes       = 1 << 30
+	defaultLogSearchMaxMatches = 1000
+	maxLogSearchContext        = 20
+	maxLogSearchContainers     = 100
+)
+
+var errLogSearchLimitReached = errors.New("Limit reached")
+
+type logSearch struct {
+	Matches    func(string) bool
+	Context    int   // Lines of context before and after each match
+	MaxBytes   int64 // Limit on the number of log bytes scanned across all containers
+	MaxMatches int
+}
+
+func parseLogSearch(query url.Values) (*logSearch, error) {
+	search := &logSearch{
+		MaxBytes:   defaultLogSearchMaxBytes,
+		MaxMatches: defaultLogSearchMaxMatches,
+	}
+
+	text, expression := query.Get("q"), query.Get("regex")
+	switch {
+	case text != "" && expression != "":
+		return nil, fmt.Errorf("Only one of q or regex can be used")
+	case text != "":
+		search.Matches = func(line string) bool { return strings.Contains(line, text) }
+	case expression != "":
+		compiled, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex: %s", err)
+		}
+		search.Matches = compiled.MatchString
+	default:
+		return nil, fmt.Errorf("One of q or regex is required")
+	}
+
+	if value := query.Get("context"); value != "" {
+		lines, err := strconv.Atoi(value)
+		if err != nil || lines < 0 || lines > maxLogSearchContext {
+			return nil, fmt.Errorf("Invalid context: %s, expected 0 to %d lines", value, maxLogSearchContext)
+		}
+		search.Context = lines
+	}
+	if value := query.Get("maxbytes"); value != "" {
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || bytes <= 0 || bytes > maxLogSearchMaxBytes {
+			return nil, fmt.Errorf("Invalid maxbytes: %s, expected 1 to %d", value, maxLogSearchMaxBytes)
+		}
+		search.MaxBytes = bytes
+	}
+	if value := query.Get("maxmatches"); value != "" {
+		matches, err := strconv.Atoi(value)
+		if err != nil || matches <= 0 {
+			return nil, fmt.Errorf("Invalid maxmatches: %s", value)
+		}
+		search.MaxMatches = matches
+	}
+
+	return search, nil
+}
+
+type logSearchMatch struct {
+	Type string // Always "match", lets clients tell matches from the summary in the stream
+	taggedLogEntry
+	Before []string
+	After  []string
+}
+
+type logSearchSummary struct {
+	Type              string // Always "summary"
+	ContainersScanned int
+	BytesScanned      int64
+	Matches           int
+	Truncated         bool     // True if a limit was reached before all the logs were scanned
+	Errors            []string `json:",omitempty"`
+}
+
+// logByteCounter counts the bytes read from the daemon's log streams, including lines outside since and until, so the limit bounds the work done
+type logByteCounter struct {
+	Count int64
+	Limit int64
+}
+
+// countedReader reads no more than the counter's limit, then returns errLogSearchLimitReached
+type countedReader struct {
+	Reader  io.Reader
+	Counter *logByteCounter
+}
+
+func (r *countedReader) Read(data []byte) (int, error) {
+	remaining := r.Counter.Limit - r.Counter.Count
+	if remaining <= 0 {
+		return 0, errLogSearchLimitReached
+	}
+	if int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	count, err := r.Reader.Read(data)
+	r.Counter.Count += int64(count)
+
+	return count, err
+}
+
+// Run scans the containers logs one container at a time, emitting each match once its trailing context is available
+func (s *logSearch) Run(queryer dockerQueryer, containers containers, options *logOptions, emit func(interface{}) error) error {
+	summary := logSearchSummary{Type: "summary"}
+	counter := &logByteCounter{Limit: s.MaxBytes}
+	var clientErr error
+
+	for _, container := range containers {
+		if summary.Truncated {
+			break
+		}
+		summary.ContainersScanned++
+
+		var before []string
+		var pending []*logSearchMatch
+		emitMatch := func(match *logSearchMatch) error {
+			summary.Matches++
+			if err := emit(match); err != nil {
+				clientErr = err
+				return err
+			}
+			if summary.Matches >= s.MaxMatches {
+				summary.Truncated = true
+				return errLogSearchLimitReached
+			}
+			return nil
+		}
+
+		err := readContainerLogs(queryer, container, options, nil, counter, func(entry taggedLogEntry) error {
+			// Complete any earlier matches still waiting for trailing context
+			remaining := pending[:0]
+			for _, match := range pending {
+				match.After = append(match.After, entry.Text)
+				if len(match.After) < s.Context {
+					remaining = append(remaining, match)
+					continue
+				}
+				if err := emitMatch(match); err != nil {
+					return err
+				}
+			}
+			pending = remaining
+
+			if s.Matches(entry.Text) {
+				match := &logSearchMatch{
+					Type:           "match",
+					taggedLogEntry: entry,
+					Before:         append([]string{}, before...),
+					After:          []string{},
+				}
+				if s.Context == 0 {
+					if err := emitMatch(match); err != nil {
+						return err
+					}
+				} else {
+					pending = append(pending, match)
+				}
+			}
+
+			if s.Context > 0 {
+				before = append(before, entry.Text)
+				if len(before) > s.Context {
+					before = before[1:]
+				}
+			}
+
+			return nil
+		})
+		summary.BytesScanned = counter.Count
+		if err == errLogSearchLimitReached {
+			summary.Truncated = true
+		}
+
+		// Matches at the end of the log get whatever trailing context there was
+		for _, match := range pending {
+			if summary.Matches >= s.MaxMatches {
+				break
+			}
+			emitMatch(match)
+		}
+		if clientErr != nil {
+			return clientErr
+		}
+
+		if err != nil && err != errLogSearchLimitReached {
+			// A failure on one container should not lose the results for the others, we report it in the summary
+			log.Printf("logSearch.Run: Read logs error for id: %s error: %s\n", containerID(container), err)
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %s", containerName(container), err))
+		}
+	}
+
+	return emit(summary)
+}
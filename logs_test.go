@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func logFrame(streamType byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = streamType
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	return append(header, payload...)
+}
+
+func readAllLogEntries(t *testing.T, data []byte, tty bool, oneByte bool) []logEntry {
+	t.Helper()
+	var reader = bytes.NewReader(data)
+	var entries []logEntry
+	emit := func(entry logEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}
+	var err error
+	if oneByte {
+		err = readLogEntries(iotest.OneByteReader(reader), tty, emit)
+	} else {
+		err = readLogEntries(reader, tty, emit)
+	}
+	if err != nil {
+		t.Fatalf("readLogEntries error: %s", err)
+	}
+
+	return entries
+}
+
+func TestReadLogEntriesDemultiplexes(t *testing.T) {
+	var data []byte
+	data = append(data, logFrame(1, "out one\nout ")...)
+	data = append(data, logFrame(2, "err one\n")...)
+	data = append(data, logFrame(1, "two\n")...)
+	data = append(data, logFrame(2, "err two")...)
+	expected := []logEntry{
+		{Stream: "stdout", Text: "out one"},
+		{Stream: "stderr", Text: "err one"},
+		{Stream: "stdout", Text: "out two"},
+		{Stream: "stderr", Text: "err two"},
+	}
+
+	// Reading a byte at a time splits every header and payload across reads
+	for _, oneByte := range []bool{false, true} {
+		if entries := readAllLogEntries(t, data, false, oneByte); !reflect.DeepEqual(entries, expected) {
+			t.Errorf("oneByte %v: got %#v, expected %#v", oneByte, entries, expected)
+		}
+	}
+}
+
+func TestReadLogEntriesTimestamps(t *testing.T) {
+	entries := readAllLogEntries(t, logFrame(1, "2024-01-02T03:04:05.123456789Z hello world\n"), false, false)
+	if len(entries) != 1 || entries[0].Text != "hello world" || entries[0].Time.Nanosecond() != 123456789 {
+		t.Errorf("Unexpected entries %#v", entries)
+	}
+}
+
+func TestReadLogEntriesTruncatedFrame(t *testing.T) {
+	data := logFrame(1, "complete\npartial")
+	entries := readAllLogEntries(t, data[:len(data)-3], false, false)
+	expected := []logEntry{{Stream: "stdout", Text: "complete"}, {Stream: "stdout", Text: "part"}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got %#v, expected %#v", entries, expected)
+	}
+}
+
+func TestReadLogEntriesInvalidStream(t *testing.T) {
+	err := readLogEntries(bytes.NewReader(logFrame(7, "x\n")), false, func(logEntry) error { return nil })
+	if err == nil {
+		t.Errorf("Expected an error for stream type 7")
+	}
+}
+
+func TestReadLogEntriesCapsLineSize(t *testing.T) {
+	long := strings.Repeat("x", maxLogLineSize*2+10)
+	for _, tty := range []bool{false, true} {
+		data := []byte(long + "\nend\n")
+		if !tty {
+			data = logFrame(1, long+"\nend\n")
+		}
+		entries := readAllLogEntries(t, data, tty, false)
+		total := 0
+		for _, entry := range entries[:len(entries)-1] {
+			if len(entry.Text) > maxLogLineSize {
+				t.Errorf("tty %v: line of %d bytes is over the cap", tty, len(entry.Text))
+			}
+			total += len(entry.Text)
+		}
+		if total != len(long) || entries[len(entries)-1].Text != "end" {
+			t.Errorf("tty %v: got %d bytes in %d entries, last %q", tty, total, len(entries), entries[len(entries)-1].Text)
+		}
+	}
+}
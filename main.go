@@ -6,40 +6,210 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
-
-	"golang.org/x/net/websocket"
+	"syscall"
+	"time"
 )
 
 var (
-	dockerHost      = flag.String("dockerhost", dockerDefaultHost, "Docker host")
-	applicationPort = flag.Int("port", 8090, "Port")
+	dockerHost        = flag.String("dockerhost", dockerDefaultHost, "Docker host")
+	applicationPort   = flag.Int("port", 8090, "Port")
+	statsEnabled      = flag.Bool("stats", false, "Sample container stats and keep an in memory history")
+	statsInterval     = flag.Duration("statsinterval", 10*time.Second, "Stats sampling interval")
+	historyFile       = flag.String("historyfile", "", "Optional file to persist the stats history to, so it survives restarts")
+	resyncInterval    = flag.Duration("resyncinterval", 5*time.Minute, "How often to list the containers to catch up on any docker events that were missed")
+	tlsCert           = flag.String("tls-cert", "", "Certificate file, serves https on -port if set along with -tls-key, reloaded when it changes")
+	tlsKey            = flag.String("tls-key", "", "Private key file for -tls-cert")
+	tlsClientCA       = flag.String("tls-client-ca", "", "Optional CA certificates file, clients must present a certificate signed by one of them")
+	tlsRedirectPort   = flag.Int("tls-redirect-port", 0, "Optional port to listen for plain http on and redirect to https")
+	htpasswdFile      = flag.String("htpasswd", "", "Optional htpasswd file for basic auth, the apr1 (htpasswd -m) and sha1 (htpasswd -s) schemes are supported")
+	tokensFile        = flag.String("tokensfile", "", "Optional file of name:token lines, the tokens are accepted as bearer tokens")
+	authHeader        = flag.String("authheader", "", "Optional header with the user's name set by an authenticating proxy, i.e. X-Forwarded-User")
+	authProxies       = flag.String("authproxies", "127.0.0.1/32,::1/128", "Comma separated address ranges the -authheader is trusted from")
+	oidcIssuer        = flag.String("oidcissuer", "", "Optional OpenID Connect issuer url, browsers are sent there to log in")
+	oidcClientID      = flag.String("oidcclientid", "", "OpenID Connect client id")
+	oidcClientSecret  = flag.String("oidcclientsecret", "", "OpenID Connect client secret")
+	oidcRedirectURL   = flag.String("oidcredirecturl", "", "OpenID Connect redirect url, i.e. https://ddash.example.com"+oidcCallbackPath)
+	oidcUsernameClaim = flag.String("oidcusernameclaim", "email", "ID token claim used as the user's name")
+	auditFile         = flag.String("auditfile", "", "Optional file to append a json line to for every request, recording who looked at what, queried using GET /audit")
+	shutdownTimeout   = flag.Duration("shutdowntimeout", 10*time.Second, "How long to wait for in flight requests to complete when shutting down")
+	configPath        = flag.String("config", "", "Optional json config file of settings, table columns, an event filter and saved views, reloaded when it changes, the command line wins over the file")
+
+	queryer       dockerQueryer
+	systemQueryer dockerQueryer
+)
 
-	queryer dockerQueryer
+var (
+	// Read through currentSettings rather than here, as these are applied again when the config file or policy file changes
+	staleThreshold    = flag.Duration("stalethreshold", 15*time.Minute, "How long since the containers were last listed before /readyz reports the state as stale")
+	metricsLabels     = flag.String("metricslabels", "", "Comma separated container labels to include as labels on the /metrics container metrics")
+	redactPattern     = flag.String("redactpattern", "(?i)password|passwd|secret|token|key", "Env, label and argument names matching this regex have their values masked, empty to disable")
+	allowedOriginList = flag.String("allowedorigins", "", "Comma separated origins web sockets are accepted from, i.e. https://ddash.example.com, * for any, by default only the page's own origin")
+	maxSockets        = flag.Int("maxsockets", 1000, "Maximum web sockets open at once, 0 for no limit")
+	maxClientSockets  = flag.Int("maxclientsockets", 20, "Maximum web sockets open at once for each user, or address if not authenticated, 0 for no limit")
+	rateLimit         = flag.Float64("ratelimit", 0, "Requests per second allowed for each user, or address if not authenticated, 0 for no limit")
+	rateBurst         = flag.Int("rateburst", 0, "Requests allowed at once before -ratelimit applies, defaults to the rate")
+	authFailureLimit  = flag.Float64("authfailurelimit", 0.1, "Failed logins per second allowed for each address, 0 for no limit")
+	authFailureBurst  = flag.Int("authfailureburst", 10, "Failed logins allowed at once before -authfailurelimit applies")
+	policyFile        = flag.String("policyfile", "", "Optional json file of policies giving users visibility of containers by label, users without a policy see no containers")
 )
 
-func init() {
+// configure is called from main rather than init, so the flags are not parsed when the package is tested
+func configure() {
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
 
-	queryer = newDockerQueryer(*dockerHost)
+	// The file's settings are set on the flags, so everything below sees them
+	var err error
+	if configuration, err = newConfigWatcher(*configPath); err != nil {
+		log.Fatalf("Config error : %s", err)
+	}
+
+	queryer = newDockerQueryer(*dockerHost, dockerAPIVersion)
+	systemQueryer = newDockerQueryer(*dockerHost, dockerSystemAPIVersion)
+
+	if *statsEnabled {
+		metricsHist = newMetricsHistory(*historyFile)
+		if err := metricsHist.Load(); err != nil {
+			log.Printf("configure: Load stats history error, will start with an empty history: %s\n", err)
+		}
+	}
+}
+
+// newAuthenticators is empty if no authentication is configured, otherwise every request needs credentials one of them accepts
+func newAuthenticators() ([]authenticator, error) {
+	var authenticators []authenticator
+	if *authHeader != "" {
+		authenticator, err := newHeaderAuthenticator(*authHeader, *authProxies)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if *tokensFile != "" {
+		authenticator, err := newTokenAuthenticator(*tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if *htpasswdFile != "" {
+		authenticator, err := newHtpasswdAuthenticator(*htpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" || *oidcRedirectURL == "" {
+			return nil, fmt.Errorf("-oidcclientid and -oidcredirecturl are needed with -oidcissuer")
+		}
+		authenticator, err := newOIDCAuthenticator(*oidcIssuer, *oidcClientID, *oidcClientSecret, *oidcRedirectURL, *oidcUsernameClaim)
+		if err != nil {
+			return nil, err
+		}
+		http.HandleFunc(oidcLoginPath, authenticator.LoginHandler)
+		http.HandleFunc(oidcCallbackPath, authenticator.CallbackHandler)
+		http.HandleFunc(oidcLogoutPath, authenticator.LogoutHandler)
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if len(authenticators) == 0 {
+		log.Println("newAuthenticators: No authentication is configured, anyone who can reach the port can see everything")
+	}
+
+	return authenticators, nil
 }
 
 func main() {
-	go eventDistr.Run(queryer)
+	configure()
+
+	authenticators, err := newAuthenticators()
+	if err != nil {
+		log.Fatalf("Authentication error : %s", err)
+	}
+	// Applied once authentication is configured, as policies need it
+	if err := configuration.Start(len(authenticators) > 0); err != nil {
+		log.Fatalf("Config error : %s", err)
+	}
+	go configuration.Run()
+
+	go eventDistr.Run(queryer, *resyncInterval)
+	if metricsHist != nil {
+		go newStatsSampler(*statsInterval, metricsHist).Run(queryer)
+	}
 
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/containers", containersHandler)
 	http.HandleFunc("/containers/", containerHandler)
-	http.Handle("/events", websocket.Handler(eventsHandler))
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/logs", logsHandler)
+	http.HandleFunc("/logs/search", logsSearchHandler)
+	http.HandleFunc("/host", hostHandler)
+	http.HandleFunc("/system/df", diskUsageHandler)
+	http.HandleFunc("/metrics", prometheusHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/audit", auditQueryHandler)
+	http.HandleFunc("/config", configHandler)
+
+	if *auditFile != "" {
+		if audit, err = newAuditLog(*auditFile); err != nil {
+			log.Fatalf("Audit log error : %s", err)
+		}
+	}
 
 	addr := fmt.Sprintf(":%d", *applicationPort)
 	log.Printf("Using runtime %s\n", runtime.Version())
 	log.Printf("Commit = %s build @ %s Full commit = %s\n", shortCommitHash, buildDate, commitHash)
-	log.Printf("About to listen at %s", addr)
 
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
-		log.Fatalf("Listen and server error : %s", err)
+	servers := []*http.Server{{Addr: addr, Handler: authFailureLimitHandler(authHandler(rateLimitHandler(auditHandler(http.DefaultServeMux, audit), requestLimiter), authenticators), authFailureLimiter)}}
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("Both -tls-cert and -tls-key are needed for https")
+		}
+		files, err := newTLSFiles(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("TLS error : %s", err)
+		}
+		go files.Run()
+		servers[0].TLSConfig = files.ServerConfig()
+
+		if *tlsRedirectPort != 0 {
+			redirectAddr := fmt.Sprintf(":%d", *tlsRedirectPort)
+			log.Printf("About to listen at %s to redirect to https", redirectAddr)
+			redirectServer := &http.Server{Addr: redirectAddr, Handler: httpsRedirectHandler(*applicationPort)}
+			servers = append(servers, redirectServer)
+			go func() {
+				if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatalf("Listen and server error : %s", err)
+				}
+			}()
+		}
+	}
+
+	server := servers[0]
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("About to listen at %s with https", addr)
+			// The certificate comes from the config, which is reloaded when the files change
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("About to listen at %s", addr)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("Listen and server error : %s", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Got signal %s, shutting down\n", <-signals)
+
+	if err := shutdown(*shutdownTimeout, servers...); err != nil {
 		os.Exit(1)
 	}
 
@@ -0,0 +1,408 @@
+package main
+
+// See
+// https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+// https://openid.net/specs/openid-connect-discovery-1_0.html
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginPath    = "/oidc/login"
+	oidcCallbackPath = "/oidc/callback"
+	oidcLogoutPath   = "/oidc/logout"
+
+	sessionCookieName = "ddash_session"
+	stateCookieName   = "ddash_oidc_state"
+	sessionDuration   = 12 * time.Hour
+	loginDuration     = 10 * time.Minute // How long the user has to log in at the identity provider
+)
+
+// oidcAuthenticator logs browsers in with the authorization code flow, the result is kept in a signed session cookie
+// The signing key is generated on start up, so everyone logs in again after a restart
+type oidcAuthenticator struct {
+	Mutex                 sync.Mutex
+	Issuer                string
+	ClientID              string
+	ClientSecret          string
+	RedirectURL           string
+	UsernameClaim         string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+	Keys                  map[string]*rsa.PublicKey // By key id
+	SessionKey            []byte
+	Client                *http.Client
+}
+
+type oidcSession struct {
+	Name    string
+	Expires int64
+}
+
+type oidcLoginState struct {
+	State   string
+	Nonce   string
+	Next    string
+	Expires int64
+}
+
+func newOIDCAuthenticator(issuer, clientID, clientSecret, redirectURL, usernameClaim string) (*oidcAuthenticator, error) {
+	authenticator := &oidcAuthenticator{
+		Issuer:        strings.TrimSuffix(issuer, "/"),
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		RedirectURL:   redirectURL,
+		UsernameClaim: usernameClaim,
+		Keys:          make(map[string]*rsa.PublicKey),
+		SessionKey:    randomBytes(32),
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := authenticator.getJSON(authenticator.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("Discovery error: %s", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != authenticator.Issuer {
+		return nil, fmt.Errorf("Discovery issuer %s does not match %s", discovery.Issuer, issuer)
+	}
+	authenticator.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+	authenticator.TokenEndpoint = discovery.TokenEndpoint
+	authenticator.JWKSURI = discovery.JWKSURI
+
+	return authenticator, nil
+}
+
+func (a *oidcAuthenticator) Authenticate(r *http.Request) (*identity, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, nil
+	}
+
+	var session oidcSession
+	if err := a.verify(sessionCookieName, cookie.Value, &session); err != nil {
+		return nil, fmt.Errorf("Invalid session cookie: %s", err)
+	}
+	if session.Name == "" {
+		return nil, fmt.Errorf("Invalid session cookie: No name")
+	}
+	// An expired session is the same as no session, so browsers are sent to log in again
+	if time.Now().Unix() > session.Expires {
+		return nil, nil
+	}
+
+	return &identity{Name: session.Name, Method: "oidc"}, nil
+}
+
+// LoginHandler sends the browser to the identity provider, next is where to come back to once logged in
+func (a *oidcAuthenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+	// Only local paths, otherwise the login could be used to redirect to anywhere
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+
+	state := oidcLoginState{
+		State:   base64.RawURLEncoding.EncodeToString(randomBytes(16)),
+		Nonce:   base64.RawURLEncoding.EncodeToString(randomBytes(16)),
+		Next:    next,
+		Expires: time.Now().Add(loginDuration).Unix(),
+	}
+	a.setCookie(w, stateCookieName, a.sign(stateCookieName, state), loginDuration)
+
+	parameters := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.ClientID},
+		"redirect_uri":  {a.RedirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state.State},
+		"nonce":         {state.Nonce},
+	}
+	separator := "?"
+	if strings.Contains(a.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, a.AuthorizationEndpoint+separator+parameters.Encode(), http.StatusFound)
+}
+
+// CallbackHandler exchanges the code for an id token, checks it and starts the session
+func (a *oidcAuthenticator) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if message := query.Get("error"); message != "" {
+		log.Printf("oidcAuthenticator.CallbackHandler: Identity provider error: %s %s", message, query.Get("error_description"))
+		http.Error(w, "Login failed: "+message, http.StatusUnauthorized)
+		return
+	}
+
+	var state oidcLoginState
+	cookie, err := r.Cookie(stateCookieName)
+	if err == nil {
+		err = a.verify(stateCookieName, cookie.Value, &state)
+	}
+	if err != nil || time.Now().Unix() > state.Expires || !hmac.Equal([]byte(query.Get("state")), []byte(state.State)) {
+		log.Printf("oidcAuthenticator.CallbackHandler: Missing, expired or mismatched login state from %s", r.RemoteAddr)
+		http.Error(w, "Login failed, please try again", http.StatusBadRequest)
+		return
+	}
+	a.setCookie(w, stateCookieName, "", -1)
+
+	name, err := a.exchange(query.Get("code"), state.Nonce)
+	if err != nil {
+		log.Printf("oidcAuthenticator.CallbackHandler: Login error: %s", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("oidcAuthenticator.CallbackHandler: Logged in %s", name)
+	a.setCookie(w, sessionCookieName, a.sign(sessionCookieName, oidcSession{Name: name, Expires: time.Now().Add(sessionDuration).Unix()}), sessionDuration)
+	http.Redirect(w, r, state.Next, http.StatusFound)
+}
+
+func (a *oidcAuthenticator) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.setCookie(w, sessionCookieName, "", -1)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "Logged out")
+}
+
+// exchange gets the id token for the code and returns the user's name from it
+func (a *oidcAuthenticator) exchange(code, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {a.RedirectURL},
+	}
+	request, err := http.NewRequest("POST", a.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	resp, err := a.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+
+	claims, err := a.verifyIDToken(tokens.IDToken, nonce)
+	if err != nil {
+		return "", err
+	}
+	name, _ := claims[a.UsernameClaim].(string)
+	if name == "" {
+		return "", fmt.Errorf("ID token has no %s claim", a.UsernameClaim)
+	}
+
+	return name, nil
+}
+
+// verifyIDToken checks the signature, which must be RS256, and the issuer, audience, expiry and nonce claims
+func (a *oidcAuthenticator) verifyIDToken(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ID token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Invalid ID token header: %s", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported ID token algorithm: %s", header.Alg)
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ID token signature encoding: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("Invalid ID token signature: %s", err)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Invalid ID token claims: %s", err)
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != a.Issuer {
+		return nil, fmt.Errorf("ID token issuer %s is not %s", issuer, a.Issuer)
+	}
+	audienceMatched := false
+	switch audience := claims["aud"].(type) {
+	case string:
+		audienceMatched = audience == a.ClientID
+	case []interface{}:
+		for _, item := range audience {
+			if item == a.ClientID {
+				audienceMatched = true
+			}
+		}
+	}
+	if !audienceMatched {
+		return nil, fmt.Errorf("ID token audience does not include %s", a.ClientID)
+	}
+	if expires, _ := claims["exp"].(float64); time.Now().Unix() > int64(expires) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if claimed, _ := claims["nonce"].(string); claimed != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+// key returns the provider's signing key, the keys are fetched again for a key id we have not seen as providers rotate them
+func (a *oidcAuthenticator) key(id string) (*rsa.PublicKey, error) {
+	a.Mutex.Lock()
+	key, ok := a.Keys[id]
+	a.Mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var keySet struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(a.JWKSURI, &keySet); err != nil {
+		return nil, fmt.Errorf("Get signing keys error: %s", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, item := range keySet.Keys {
+		if item.Kty != "RSA" {
+			continue
+		}
+		modulus, err := base64.RawURLEncoding.DecodeString(item.N)
+		if err != nil {
+			continue
+		}
+		exponent, err := base64.RawURLEncoding.DecodeString(item.E)
+		if err != nil {
+			continue
+		}
+		keys[item.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+	}
+
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+	a.Keys = keys
+	if key, ok = keys[id]; !ok {
+		return nil, fmt.Errorf("No signing key with id: %s", id)
+	}
+
+	return key, nil
+}
+
+func (a *oidcAuthenticator) getJSON(url string, value interface{}) error {
+	resp, err := a.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// sign encodes the value as json with an hmac, so cookies can not be altered by the browser
+// The cookie's name is part of the hmac, so one kind of cookie can not be passed off as another, i.e. the login state as a session
+func (a *oidcAuthenticator) sign(name string, value interface{}) string {
+	data, _ := json.Marshal(value)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + a.mac(name, payload)
+}
+
+func (a *oidcAuthenticator) verify(name, signed string, value interface{}) error {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("Not a signed value")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(a.mac(name, parts[0]))) {
+		return fmt.Errorf("Signature does not match")
+	}
+
+	return decodeSegment(parts[0], value)
+}
+
+func (a *oidcAuthenticator) mac(name, payload string) string {
+	mac := hmac.New(sha256.New, a.SessionKey)
+	mac.Write([]byte(name + "." + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setCookie is secure if the redirect url is https, a negative max age removes the cookie
+func (a *oidcAuthenticator) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+func randomBytes(count int) []byte {
+	data := make([]byte, count)
+	if _, err := rand.Read(data); err != nil {
+		log.Fatalf("randomBytes: Read error: %s", err)
+	}
+
+	return data
+}
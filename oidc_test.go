@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "ddash"
+	testClientSecret = "client secret"
+	testRedirectURL  = "https://ddash.example.com" + oidcCallbackPath
+)
+
+// fakeIdP is a local identity provider, the authorize endpoint logs everyone in as alice
+// Tokens are the claims for the login, Token changes them and how they are signed to test the checks
+type fakeIdP struct {
+	Mutex     sync.Mutex
+	Server    *httptest.Server
+	Key       *rsa.PrivateKey
+	KeyID     string
+	Issuer    string // Reported by discovery, the server's url if empty
+	Codes     map[string]string
+	Token     func(idp *fakeIdP, claims map[string]interface{}) string
+	KeyGets   int
+	Exchanges int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{Key: key, KeyID: "key-1", Codes: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.Issuer
+		if issuer == "" {
+			issuer = idp.Server.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": idp.Server.URL + "/authorize",
+			"token_endpoint":         idp.Server.URL + "/token",
+			"jwks_uri":               idp.Server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.Mutex.Lock()
+		idp.KeyGets++
+		idp.Mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "EC", "kid": "ignored"},
+				{
+					"kty": "RSA",
+					"kid": idp.KeyID,
+					"n":   base64.RawURLEncoding.EncodeToString(idp.Key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.Key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("response_type") != "code" || query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+			http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+			return
+		}
+		code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+		idp.Mutex.Lock()
+		idp.Codes[code] = query.Get("nonce")
+		idp.Mutex.Unlock()
+		http.Redirect(w, r, testRedirectURL+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		if r.Method != "POST" || clientID != testClientID || clientSecret != testClientSecret {
+			http.Error(w, "Invalid client", http.StatusUnauthorized)
+			return
+		}
+		idp.Mutex.Lock()
+		nonce, ok := idp.Codes[r.PostFormValue("code")]
+		delete(idp.Codes, r.PostFormValue("code"))
+		idp.Exchanges++
+		idp.Mutex.Unlock()
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL {
+			http.Error(w, "Invalid grant", http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   idp.Server.URL,
+			"sub":   "1234",
+			"aud":   testClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": nonce,
+			"email": "alice@example.com",
+		}
+		token := idp.sign(map[string]interface{}{"alg": "RS256", "kid": idp.KeyID}, claims, idp.Key)
+		if idp.Token != nil {
+			token = idp.Token(idp, claims)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": token})
+	})
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+func (idp *fakeIdP) sign(header, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	encode := func(value interface{}) string {
+		data, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login goes through the flow as a browser would, returning the callback's response
+// tamper can change the callback request, i.e. to alter the state
+func (idp *fakeIdP) login(t *testing.T, authenticator *oidcAuthenticator, next string, tamper func(r *http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	authenticator.LoginHandler(recorder, httptest.NewRequest("GET", oidcLoginPath+"?next="+url.QueryEscape(next), nil))
+	if recorder.Code != http.StatusFound || !strings.HasPrefix(recorder.Header().Get("Location"), idp.Server.URL+"/authorize?") {
+		t.Fatalf("Login: got %d to %s, expected a redirect to the identity provider", recorder.Code, recorder.Header().Get("Location"))
+	}
+	stateCookies := recorder.Result().Cookies()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(callback, testRedirectURL+"?") {
+		t.Fatalf("Authorize: got %s to %s, expected a redirect to the callback", resp.Status, callback)
+	}
+
+	request := httptest.NewRequest("GET", strings.TrimPrefix(callback, "https://ddash.example.com"), nil)
+	for _, cookie := range stateCookies {
+		request.AddCookie(cookie)
+	}
+	if tamper != nil {
+		tamper(request)
+	}
+	recorder = httptest.NewRecorder()
+	authenticator.CallbackHandler(recorder, request)
+
+	return recorder
+}
+
+func newTestOIDCAuthenticator(t *testing.T, idp *fakeIdP) *oidcAuthenticator {
+	t.Helper()
+	authenticator, err := newOIDCAuthenticator(idp.Server.URL+"/", testClientID, testClientSecret, testRedirectURL, "email")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	return authenticator
+}
+
+func sessionCookie(recorder *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+
+	authenticator := newTestOIDCAuthenticator(t, idp)
+	if authenticator.Issuer != idp.Server.URL || authenticator.AuthorizationEndpoint != idp.Server.URL+"/authorize" ||
+		authenticator.TokenEndpoint != idp.Server.URL+"/token" || authenticator.JWKSURI != idp.Server.URL+"/jwks" {
+		t.Errorf("Unexpected endpoints %#v", authenticator)
+	}
+
+	idp.Issuer = "https://other.example.com"
+	if _, err := newOIDCAuthenticator(idp.Server.URL, testClientID, testClientSecret, testRedirectURL, "email"); err == nil {
+		t.Errorf("Expected an error for a discovery issuer that does not match")
+	}
+
+	if _, err := newOIDCAuthenticator(idp.Server.URL+"/missing", testClientID, testClientSecret, testRedirectURL, "email"); err == nil {
+		t.Errorf("Expected an error for an issuer without discovery")
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+	authenticator := newTestOIDCAuthenticator(t, idp)
+
+	recorder := idp.login(t, authenticator, "/containers?all=1", nil)
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/containers?all=1" {
+		t.Fatalf("Callback: got %d to %s, expected a redirect to next", recorder.Code, recorder.Header().Get("Location"))
+	}
+	cookie := sessionCookie(recorder)
+	if cookie == nil || !cookie.HttpOnly || !cookie.Secure {
+		t.Fatalf("Expected a secure http only session cookie, got %#v", cookie)
+	}
+
+	request := httptest.NewRequest("GET", "/containers", nil)
+	request.AddCookie(cookie)
+	if id, err := authenticator.Authenticate(request); err != nil || id == nil || id.Name != "alice@example.com" || id.Method != "oidc" {
+		t.Errorf("Authenticate: got %#v and %v, expected alice", id, err)
+	}
+
+	// The keys are kept, so logging in again does not fetch them again
+	idp.login(t, authenticator, "/", nil)
+	if idp.KeyGets != 1 || idp.Exchanges != 2 {
+		t.Errorf("Got %d key gets and %d exchanges, expected 1 and 2", idp.KeyGets, idp.Exchanges)
+	}
+
+	// Only local paths are followed after logging in
+	for _, next := range []string{"https://evil.example.com", "//evil.example.com", "/\\evil.example.com"} {
+		if recorder := idp.login(t, authenticator, next, nil); recorder.Header().Get("Location") != "/" {
+			t.Errorf("%s: redirected to %s, expected /", next, recorder.Header().Get("Location"))
+		}
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+	authenticator := newTestOIDCAuthenticator(t, idp)
+
+	request := httptest.NewRequest("GET", "/containers", nil)
+	if id, err := authenticator.Authenticate(request); id != nil || err != nil {
+		t.Errorf("No cookie: got %#v and %v, expected neither", id, err)
+	}
+
+	// The payload of one session with the signature of another
+	valid := strings.Split(authenticator.sign(sessionCookieName, oidcSession{Name: "alice@example.com", Expires: time.Now().Add(time.Hour).Unix()}), ".")
+	forged := strings.Split(authenticator.sign(sessionCookieName, oidcSession{Name: "admin", Expires: time.Now().Add(time.Hour).Unix()}), ".")
+	tampered := forged[0] + "." + valid[1]
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tampered})
+	if id, err := authenticator.Authenticate(request); id != nil || err == nil {
+		t.Errorf("Tampered cookie: got %#v and %v, expected an error", id, err)
+	}
+
+	request = httptest.NewRequest("GET", "/containers", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: authenticator.sign(sessionCookieName, oidcSession{Name: "alice@example.com", Expires: time.Now().Add(-time.Minute).Unix()})})
+	if id, err := authenticator.Authenticate(request); id != nil || err != nil {
+		t.Errorf("Expired session: got %#v and %v, expected neither so the browser logs in again", id, err)
+	}
+}
+
+func TestOIDCStateCookieIsNotASession(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+	authenticator := newTestOIDCAuthenticator(t, idp)
+
+	// Anyone can get a login state cookie, as the login needs no credentials
+	recorder := httptest.NewRecorder()
+	authenticator.LoginHandler(recorder, httptest.NewRequest("GET", oidcLoginPath, nil))
+	var state *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == stateCookieName {
+			state = cookie
+		}
+	}
+	if state == nil {
+		t.Fatalf("Login did not set the state cookie")
+	}
+
+	request := httptest.NewRequest("GET", "/containers", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: state.Value})
+	if id, err := authenticator.Authenticate(request); id != nil || err == nil {
+		t.Errorf("State cookie replayed as the session: got %#v and %v, expected an error", id, err)
+	}
+
+	// Nor a session as the login state
+	login := idp.login(t, authenticator, "/", nil)
+	if recorder := idp.login(t, authenticator, "/", func(r *http.Request) {
+		r.Header.Del("Cookie")
+		r.AddCookie(&http.Cookie{Name: stateCookieName, Value: sessionCookie(login).Value})
+	}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Session replayed as the state: got %d, expected %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	request = httptest.NewRequest("GET", "/containers", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: authenticator.sign(sessionCookieName, oidcSession{Expires: time.Now().Add(time.Hour).Unix()})})
+	if id, err := authenticator.Authenticate(request); id != nil || err == nil {
+		t.Errorf("Session without a name: got %#v and %v, expected an error", id, err)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+	authenticator := newTestOIDCAuthenticator(t, idp)
+
+	tests := []struct {
+		Name   string
+		Tamper func(r *http.Request)
+	}{
+		{"Different state", func(r *http.Request) {
+			query := r.URL.Query()
+			query.Set("state", "other")
+			r.URL.RawQuery = query.Encode()
+		}},
+		{"No state cookie", func(r *http.Request) { r.Header.Del("Cookie") }},
+		{"Unsigned state cookie", func(r *http.Request) {
+			r.Header.Del("Cookie")
+			r.AddCookie(&http.Cookie{Name: stateCookieName, Value: base64.RawURLEncoding.EncodeToString([]byte(`{"State":"x"}`)) + ".x"})
+		}},
+	}
+	for _, test := range tests {
+		recorder := idp.login(t, authenticator, "/", test.Tamper)
+		if recorder.Code != http.StatusBadRequest || sessionCookie(recorder) != nil {
+			t.Errorf("%s: got %d, expected %d without a session", test.Name, recorder.Code, http.StatusBadRequest)
+		}
+	}
+	if idp.Exchanges != 0 {
+		t.Errorf("Got %d exchanges, expected the code not to be exchanged", idp.Exchanges)
+	}
+}
+
+func TestOIDCIDTokenRejected(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Server.Close()
+	authenticator := newTestOIDCAuthenticator(t, idp)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := func(idp *fakeIdP) map[string]interface{} {
+		return map[string]interface{}{"alg": "RS256", "kid": idp.KeyID}
+	}
+	tests := []struct {
+		Name  string
+		Token func(idp *fakeIdP, claims map[string]interface{}) string
+	}{
+		{"Wrong audience", func(idp *fakeIdP, claims map[string]interface{}) string {
+			claims["aud"] = "other"
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"Wrong audience list", func(idp *fakeIdP, claims map[string]interface{}) string {
+			claims["aud"] = []string{"other", "another"}
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"Wrong issuer", func(idp *fakeIdP, claims map[string]interface{}) string {
+			claims["iss"] = "https://other.example.com"
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"Expired", func(idp *fakeIdP, claims map[string]interface{}) string {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"No expiry", func(idp *fakeIdP, claims map[string]interface{}) string {
+			delete(claims, "exp")
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"Wrong nonce", func(idp *fakeIdP, claims map[string]interface{}) string {
+			claims["nonce"] = "other"
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"No username claim", func(idp *fakeIdP, claims map[string]interface{}) string {
+			delete(claims, "email")
+			return idp.sign(header(idp), claims, idp.Key)
+		}},
+		{"Other key", func(idp *fakeIdP, claims map[string]interface{}) string {
+			return idp.sign(header(idp), claims, otherKey)
+		}},
+		{"Unknown key id", func(idp *fakeIdP, claims map[string]interface{}) string {
+			return idp.sign(map[string]interface{}{"alg": "RS256", "kid": "key-2"}, claims, idp.Key)
+		}},
+		{"Algorithm none", func(idp *fakeIdP, claims map[string]interface{}) string {
+			token := idp.sign(map[string]interface{}{"alg": "none", "kid": idp.KeyID}, claims, idp.Key)
+			return token[:strings.LastIndex(token, ".")+1]
+		}},
+		{"Altered claims", func(idp *fakeIdP, claims map[string]interface{}) string {
+			parts := strings.Split(idp.sign(header(idp), claims, idp.Key), ".")
+			claims["email"] = "admin@example.com"
+			altered := strings.Split(idp.sign(header(idp), claims, idp.Key), ".")
+			return parts[0] + "." + altered[1] + "." + parts[2]
+		}},
+		{"Not a JWT", func(idp *fakeIdP, claims map[string]interface{}) string {
+			return "opaque"
+		}},
+	}
+	for _, test := range tests {
+		idp.Token = test.Token
+		recorder := idp.login(t, authenticator, "/", nil)
+		if recorder.Code != http.StatusUnauthorized || sessionCookie(recorder) != nil {
+			t.Errorf("%s: got %d, expected %d without a session", test.Name, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// A key id we have not seen is fetched again, so a rotated key is picked up
+	idp.Token = nil
+	idp.KeyID = "key-2"
+	if recorder := idp.login(t, authenticator, "/", nil); recorder.Code != http.StatusFound || sessionCookie(recorder) == nil {
+		t.Errorf("Rotated key: got %d, expected a session", recorder.Code)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field paths address values within json documents such as the container inspect document
+//
+//	State.Status
+//	Config.Labels["com.docker.compose.project"]
+//	Mounts[0].Source
+type pathSegment struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+type fieldPath []pathSegment
+
+func parseFieldPath(value string) (fieldPath, error) {
+	var path fieldPath
+	remaining := value
+	expectKey := true
+	for remaining != "" {
+		switch {
+		case remaining[0] == '[':
+			// Quoted keys are scanned as a whole, so they can contain ] and \ escapes the next character as in filter expressions
+			inner := strings.TrimLeft(remaining[1:], " ")
+			var segment pathSegment
+			if inner != "" && (inner[0] == '"' || inner[0] == '\'') {
+				end, key, err := scanQuoted(inner, 0)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid field path: %s, unterminated key", value)
+				}
+				segment, inner = pathSegment{Key: key}, inner[end:]
+			} else {
+				end := strings.IndexByte(inner, ']')
+				if end < 0 {
+					return nil, fmt.Errorf("Invalid field path: %s, missing ]", value)
+				}
+				index, err := strconv.Atoi(strings.TrimSpace(inner[:end]))
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("Invalid field path: %s, expected a quoted key or an index within []", value)
+				}
+				segment, inner = pathSegment{Index: index, IsIndex: true}, inner[end:]
+			}
+			inner = strings.TrimLeft(inner, " ")
+			if inner == "" || inner[0] != ']' {
+				return nil, fmt.Errorf("Invalid field path: %s, missing ]", value)
+			}
+			path = append(path, segment)
+			remaining = inner[1:]
+			expectKey = false
+		case remaining[0] == '.':
+			if expectKey {
+				return nil, fmt.Errorf("Invalid field path: %s, unexpected .", value)
+			}
+			remaining = remaining[1:]
+			expectKey = true
+			if remaining == "" {
+				return nil, fmt.Errorf("Invalid field path: %s, trailing .", value)
+			}
+		default:
+			if !expectKey {
+				return nil, fmt.Errorf("Invalid field path: %s, expected . or [", value)
+			}
+			end := strings.IndexAny(remaining, ".[")
+			if end < 0 {
+				end = len(remaining)
+			}
+			path = append(path, pathSegment{Key: remaining[:end]})
+			remaining = remaining[end:]
+			expectKey = false
+		}
+	}
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Invalid field path: %s, empty", value)
+	}
+
+	return path, nil
+}
+
+// lookup returns the value at the path, ok is false if any part of the path does not exist
+func (p fieldPath) lookup(document interface{}) (interface{}, bool) {
+	current := document
+	for _, segment := range p {
+		if segment.IsIndex {
+			list, ok := current.([]interface{})
+			if !ok || segment.Index >= len(list) {
+				return nil, false
+			}
+			current = list[segment.Index]
+			continue
+		}
+
+		var value interface{}
+		var ok bool
+		switch typed := current.(type) {
+		case map[string]interface{}:
+			value, ok = typed[segment.Key]
+		case container:
+			value, ok = typed[segment.Key]
+		case event:
+			value, ok = typed[segment.Key]
+		}
+		if !ok {
+			return nil, false
+		}
+		current = value
+	}
+
+	return current, true
+}
+
+// set stores the value at the path within the document, creating intermediate maps and lists as needed
+// Maps and lists already in the document are copied before they are changed, as they can be shared with the document the value came from
+func (p fieldPath) set(document map[string]interface{}, value interface{}) {
+	if len(p) == 0 || p[0].IsIndex {
+		return
+	}
+
+	document[p[0].Key] = p[1:].setWithin(document[p[0].Key], value)
+}
+
+// setWithin returns a copy of current with the value stored at the path
+func (p fieldPath) setWithin(current, value interface{}) interface{} {
+	if len(p) == 0 {
+		return value
+	}
+
+	segment := p[0]
+	if segment.IsIndex {
+		existing, _ := current.([]interface{})
+		size := len(existing)
+		if segment.Index >= size {
+			size = segment.Index + 1
+		}
+		list := make([]interface{}, size)
+		copy(list, existing)
+		list[segment.Index] = p[1:].setWithin(list[segment.Index], value)
+		return list
+	}
+
+	existing, _ := current.(map[string]interface{})
+	object := make(map[string]interface{}, len(existing)+1)
+	for key, item := range existing {
+		object[key] = item
+	}
+	object[segment.Key] = p[1:].setWithin(existing[segment.Key], value)
+
+	return object
+}
+
+// parseDocumentPath parses a field path that may also be written in the JSONPath ($.State.Health) or jq (.State.Health) style
+func parseDocumentPath(value string) (fieldPath, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(value), "$")
+	if strings.HasPrefix(trimmed, ".") {
+		trimmed = trimmed[1:]
+	}
+
+	return parseFieldPath(trimmed)
+}
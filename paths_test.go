@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected fieldPath
+	}{
+		{"State", fieldPath{{Key: "State"}}},
+		{"State.Status", fieldPath{{Key: "State"}, {Key: "Status"}}},
+		{`Config.Labels["com.docker.compose.project"]`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: "com.docker.compose.project"}}},
+		{`Config.Labels['team']`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: "team"}}},
+		{`Config.Labels["a]b"]`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: "a]b"}}},
+		{`Config.Labels['a]b']`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: "a]b"}}},
+		{`Config.Labels["say \"hi\""]`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: `say "hi"`}}},
+		{`Config.Labels[ "team" ]`, fieldPath{{Key: "Config"}, {Key: "Labels"}, {Key: "team"}}},
+		{"Mounts[0].Source", fieldPath{{Key: "Mounts"}, {Index: 0, IsIndex: true}, {Key: "Source"}}},
+		{"Mounts[ 12 ]", fieldPath{{Key: "Mounts"}, {Index: 12, IsIndex: true}}},
+		{`Labels["a"]["b"]`, fieldPath{{Key: "Labels"}, {Key: "a"}, {Key: "b"}}},
+	}
+	for _, test := range tests {
+		path, err := parseFieldPath(test.Value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Value, err)
+			continue
+		}
+		if !reflect.DeepEqual(path, test.Expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.Value, path, test.Expected)
+		}
+	}
+
+	invalid := []string{"", ".State", "State.", "State..Status", `Labels["team"`, `Labels["team]`, "Mounts[-1]", "Mounts[x]", `Labels["a"]b`, `Labels["a" x]`, "Mounts[0"}
+	for _, value := range invalid {
+		if _, err := parseFieldPath(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestFieldPathSet(t *testing.T) {
+	tests := []struct {
+		Paths    []string
+		Expected map[string]interface{}
+	}{
+		{[]string{"Name"}, map[string]interface{}{"Name": "value"}},
+		{[]string{"State.Status", "State.Pid"}, map[string]interface{}{"State": map[string]interface{}{"Status": "value", "Pid": "value"}}},
+		{[]string{`Config.Labels["a]b"]`}, map[string]interface{}{"Config": map[string]interface{}{"Labels": map[string]interface{}{"a]b": "value"}}}},
+		{[]string{"Mounts[1].Source"}, map[string]interface{}{"Mounts": []interface{}{nil, map[string]interface{}{"Source": "value"}}}},
+		{[]string{"Mounts[1].Source", "Mounts[0].Source"}, map[string]interface{}{"Mounts": []interface{}{map[string]interface{}{"Source": "value"}, map[string]interface{}{"Source": "value"}}}},
+		{[]string{"Mounts[0]"}, map[string]interface{}{"Mounts": []interface{}{"value"}}},
+	}
+	for _, test := range tests {
+		document := map[string]interface{}{}
+		for _, value := range test.Paths {
+			path, err := parseFieldPath(value)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", value, err)
+			}
+			path.set(document, "value")
+		}
+		if !reflect.DeepEqual(document, test.Expected) {
+			t.Errorf("%v: got %#v, expected %#v", test.Paths, document, test.Expected)
+		}
+	}
+}
+
+func TestFieldPathSetDoesNotChangeSharedValues(t *testing.T) {
+	config := map[string]interface{}{"Image": "nginx", "Env": []interface{}{"A=1"}}
+	source := container{"Config": config}
+
+	projected := map[string]interface{}{}
+	for _, value := range []string{"Config", "Config.Image", "Config.Env[0]"} {
+		path, _ := parseFieldPath(value)
+		if found, ok := path.lookup(source); ok {
+			path.set(projected, found)
+		}
+	}
+	path, _ := parseFieldPath("Config.Image")
+	path.set(projected, "changed")
+	path, _ = parseFieldPath("Config.Env[0]")
+	path.set(projected, "changed")
+
+	if config["Image"] != "nginx" || config["Env"].([]interface{})[0] != "A=1" {
+		t.Errorf("The source document was changed: %#v", config)
+	}
+	if image, _ := path.lookup(projected); image != "changed" {
+		t.Errorf("Projected Env[0] is %v, expected changed", image)
+	}
+}
+
+func TestSplitFieldList(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected []string
+	}{
+		{"Id, Name ,State.Status", []string{"Id", "Name", "State.Status"}},
+		{`Config.Labels["a,b"],Name`, []string{`Config.Labels["a,b"]`, "Name"}},
+		{`Config.Labels["a]b"],Name`, []string{`Config.Labels["a]b"]`, "Name"}},
+		{`Config.Labels['a"],b'],Name`, []string{`Config.Labels['a"],b']`, "Name"}},
+		{`Config.Labels["a\"],b"],Name`, []string{`Config.Labels["a\"],b"]`, "Name"}},
+		{",,", nil},
+	}
+	for _, test := range tests {
+		if fields := splitFieldList(test.Value); !reflect.DeepEqual(fields, test.Expected) && !(len(fields) == 0 && len(test.Expected) == 0) {
+			t.Errorf("%s: got %#v, expected %#v", test.Value, fields, test.Expected)
+		}
+	}
+}
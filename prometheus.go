@@ -0,0 +1,397 @@
+package main
+
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dockerRequestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	eventLagBuckets      = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+	prometheusLabelNameRegexp *regexp.Regexp
+	selfMetrics               *ddashMetrics
+)
+
+func init() {
+	var err error
+	prometheusLabelNameRegexp, err = regexp.Compile(`[^a-zA-Z0-9_]`)
+	if err != nil {
+		panic(fmt.Sprintf("Prometheus label name regex error : %s", err))
+	}
+
+	selfMetrics = newDdashMetrics()
+}
+
+type histogram struct {
+	Buckets []float64
+	Counts  []uint64 // Cumulative as prometheus expects, one per bucket
+	Count   uint64
+	Sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for index, bound := range h.Buckets {
+		if value <= bound {
+			h.Counts[index]++
+		}
+	}
+	h.Count++
+	h.Sum += value
+}
+
+// ddashMetrics are ddash's own metrics, the container metrics are taken from the state store when scraped
+type ddashMetrics struct {
+	Mutex          sync.Mutex
+	Events         map[string]uint64 // By action, i.e. start, die
+	EventLag       *histogram        // Time from the daemon raising an event to us distributing it
+	DockerRequests map[string]*histogram
+	DockerErrors   map[string]uint64
+}
+
+func newDdashMetrics() *ddashMetrics {
+	return &ddashMetrics{
+		Events:         make(map[string]uint64),
+		EventLag:       newHistogram(eventLagBuckets),
+		DockerRequests: make(map[string]*histogram),
+		DockerErrors:   make(map[string]uint64),
+	}
+}
+
+func (m *ddashMetrics) ObserveEvent(event event, now time.Time) {
+	action, _ := event["status"].(string)
+	if value, ok := event["Action"].(string); ok {
+		action = value
+	}
+	// Health status actions include the status, i.e. "health_status: healthy", we keep the action only so the label has few values
+	if index := strings.Index(action, ":"); index > 0 {
+		action = action[:index]
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	m.Events[action]++
+	if raised := eventTime(event); !raised.IsZero() {
+		m.EventLag.observe(math.Max(0, now.Sub(raised).Seconds()))
+	}
+}
+
+func (m *ddashMetrics) ObserveDockerRequest(url string, duration time.Duration, err error) {
+	endpoint := dockerEndpoint(url)
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	requests, ok := m.DockerRequests[endpoint]
+	if !ok {
+		requests = newHistogram(dockerRequestBuckets)
+		m.DockerRequests[endpoint] = requests
+	}
+	requests.observe(duration.Seconds())
+	if err != nil {
+		m.DockerErrors[endpoint]++
+	}
+}
+
+// eventTime uses the nanosecond time newer api versions include if it is there
+func eventTime(event event) time.Time {
+	if nanos, ok := event["timeNano"].(float64); ok {
+		return time.Unix(0, int64(nanos))
+	}
+	if seconds, ok := event["time"].(float64); ok {
+		return time.Unix(int64(seconds), 0)
+	}
+
+	return time.Time{}
+}
+
+// dockerEndpoint reduces a daemon url to its endpoint, replacing the container so the label has few values, i.e. containers/{id}/json
+func dockerEndpoint(url string) string {
+	if index := strings.IndexByte(url, '?'); index >= 0 {
+		url = url[:index]
+	}
+	var parts []string
+	for _, part := range strings.Split(url, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v") && strings.Contains(parts[0], ".") {
+		parts = parts[1:]
+	}
+	if len(parts) >= 3 && parts[0] == "containers" {
+		parts[1] = "{id}"
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// prometheusWriter collects samples by metric family, samples for a family must be written together so we write them all at the end
+type prometheusWriter struct {
+	Families []*prometheusFamily
+}
+
+type prometheusFamily struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples bytes.Buffer
+}
+
+func (p *prometheusWriter) family(name, metricType, help string) *prometheusFamily {
+	for _, family := range p.Families {
+		if family.Name == name {
+			return family
+		}
+	}
+
+	family := &prometheusFamily{Name: name, Type: metricType, Help: help}
+	p.Families = append(p.Families, family)
+
+	return family
+}
+
+func (p *prometheusWriter) WriteTo(buffer *bytes.Buffer) {
+	for _, family := range p.Families {
+		fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", family.Name, family.Help, family.Name, family.Type)
+		buffer.Write(family.Samples.Bytes())
+	}
+}
+
+func (f *prometheusFamily) sample(labels []string, value float64) {
+	f.namedSample(f.Name, labels, value)
+}
+
+func (f *prometheusFamily) namedSample(name string, labels []string, value float64) {
+	f.Samples.WriteString(name)
+	if len(labels) > 0 {
+		f.Samples.WriteString("{")
+		for index := 0; index+1 < len(labels); index += 2 {
+			if index > 0 {
+				f.Samples.WriteString(",")
+			}
+			fmt.Fprintf(&f.Samples, "%s=\"%s\"", labels[index], escapeLabelValue(labels[index+1]))
+		}
+		f.Samples.WriteString("}")
+	}
+	f.Samples.WriteString(" " + formatSampleValue(value) + "\n")
+}
+
+func (f *prometheusFamily) histogram(labels []string, h *histogram) {
+	for index, bound := range h.Buckets {
+		f.namedSample(f.Name+"_bucket", withLabel(labels, "le", formatSampleValue(bound)), float64(h.Counts[index]))
+	}
+	f.namedSample(f.Name+"_bucket", withLabel(labels, "le", "+Inf"), float64(h.Count))
+	f.namedSample(f.Name+"_sum", labels, h.Sum)
+	f.namedSample(f.Name+"_count", labels, float64(h.Count))
+}
+
+// withLabel appends the label to a copy of the labels
+func withLabel(labels []string, name, value string) []string {
+	return append(labels[:len(labels):len(labels)], name, value)
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatSampleValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+// containerMetricLabels are the name, image and short id, followed by the selected container labels as label_<name>
+func containerMetricLabels(container container, labelKeys []string) []string {
+	image, _ := fieldPath{{Key: "Config"}, {Key: "Image"}}.lookup(container)
+	id := containerID(container)
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	labels := []string{"name", containerName(container), "image", cellText(image), "id", id}
+	values := containerLabels(container)
+	// The keys are checked for collisions when they are parsed, this only keeps a duplicate from failing the whole scrape
+	seen := make(map[string]bool, len(labelKeys))
+	for _, key := range labelKeys {
+		name := metricLabelName(key)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		labels = append(labels, name, cellText(values[key]))
+	}
+
+	return labels
+}
+
+// metricLabelName is the prometheus label for a container label, characters prometheus does not allow become _
+func metricLabelName(key string) string {
+	return "label_" + prometheusLabelNameRegexp.ReplaceAllString(key, "_")
+}
+
+// parseMetricsLabelKeys parses -metricslabels, keys that would have the same prometheus label, i.e. app.name and app-name, are an error
+func parseMetricsLabelKeys(value string) ([]string, error) {
+	var keys []string
+	names := make(map[string]string)
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		name := metricLabelName(key)
+		if existing, found := names[name]; found {
+			if existing == key {
+				continue
+			}
+			return nil, fmt.Errorf("%s and %s would both be %s", existing, key, name)
+		}
+		names[name] = key
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// writePrometheusMetrics writes the container metrics from the state store for the containers in scope, the latest stats if enabled, and ddash's own metrics
+func writePrometheusMetrics(p *prometheusWriter, labelKeys []string, scope *containerScope, redactor *redactor) {
+	containers, _, _ := store.Snapshot()
+	for _, container := range redactor.Containers(scope.filter(containers)) {
+		labels := containerMetricLabels(container, labelKeys)
+		value := func(path ...string) interface{} {
+			var field fieldPath
+			for _, key := range path {
+				field = append(field, pathSegment{Key: key})
+			}
+			result, _ := field.lookup(container)
+			return result
+		}
+
+		status := containerStatus(container)
+		state := p.family("ddash_container_state", "gauge", "Container state, 1 for the container's current state")
+		for _, candidate := range containerStatuses {
+			state.sample(withLabel(labels, "state", candidate), boolValue(candidate == status))
+		}
+
+		if count, ok := value("RestartCount").(float64); ok {
+			p.family("ddash_container_restart_count", "gauge", "Number of times the daemon has restarted the container").sample(labels, count)
+		}
+		if exitCode, ok := value("State", "ExitCode").(float64); ok {
+			p.family("ddash_container_exit_code", "gauge", "Exit code of the container's last run").sample(labels, exitCode)
+		}
+		if oomKilled, ok := value("State", "OOMKilled").(bool); ok {
+			p.family("ddash_container_oom_killed", "gauge", "1 if the container's last run was killed for running out of memory").sample(labels, boolValue(oomKilled))
+		}
+		if started := parseDocumentTime(value("State", "StartedAt")); !started.IsZero() {
+			p.family("ddash_container_start_time_seconds", "gauge", "Start time of the container's last run in unix seconds").sample(labels, float64(started.UnixNano())/1e9)
+		}
+		if health, ok := value("State", "Health", "Status").(string); ok {
+			healthStatus := p.family("ddash_container_health_status", "gauge", "Container health check status, 1 for the current status")
+			for _, candidate := range []string{"starting", "healthy", "unhealthy"} {
+				healthStatus.sample(withLabel(labels, "health", candidate), boolValue(candidate == health))
+			}
+		}
+
+		if metricsHist == nil {
+			continue
+		}
+		// Stopped containers are no longer sampled, so we only report recent samples
+		if point, ok := metricsHist.Latest(containerID(container), *statsInterval*3+metricsTiers[0].Resolution); ok {
+			p.family("ddash_container_cpu_usage_percent", "gauge", "Container cpu usage as a percentage of one cpu, from the last stats sample").sample(labels, point.CPUPercent)
+			p.family("ddash_container_memory_usage_bytes", "gauge", "Container memory usage from the last stats sample").sample(labels, float64(point.MemoryUsage))
+			p.family("ddash_container_memory_limit_bytes", "gauge", "Container memory limit from the last stats sample").sample(labels, float64(point.MemoryLimit))
+		}
+	}
+
+	eventDistr.Mutex.Lock()
+	subscribers := len(eventDistr.Subscribers)
+	eventDistr.Mutex.Unlock()
+	p.family("ddash_event_subscribers", "gauge", "Number of connected event web sockets").sample(nil, float64(subscribers))
+	p.family("ddash_state_generation", "gauge", "Current state generation, the resource version used by watches").sample(nil, float64(store.CurrentGeneration()))
+
+	selfMetrics.Mutex.Lock()
+	defer selfMetrics.Mutex.Unlock()
+
+	events := p.family("ddash_events_total", "counter", "Docker events received by action")
+	for _, action := range sortedKeys(selfMetrics.Events) {
+		events.sample([]string{"action", action}, float64(selfMetrics.Events[action]))
+	}
+
+	p.family("ddash_event_lag_seconds", "histogram", "Time from the daemon raising an event to ddash distributing it").histogram(nil, selfMetrics.EventLag)
+
+	endpoints := make([]string, 0, len(selfMetrics.DockerRequests))
+	for endpoint := range selfMetrics.DockerRequests {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	requests := p.family("ddash_docker_request_duration_seconds", "histogram", "Time for the daemon to respond by endpoint, streams are timed to the response headers")
+	for _, endpoint := range endpoints {
+		requests.histogram([]string{"endpoint", endpoint}, selfMetrics.DockerRequests[endpoint])
+	}
+	errors := p.family("ddash_docker_request_errors_total", "counter", "Daemon requests that failed to get a response by endpoint")
+	for _, endpoint := range sortedKeys(selfMetrics.DockerErrors) {
+		errors.sample([]string{"endpoint", endpoint}, float64(selfMetrics.DockerErrors[endpoint]))
+	}
+}
+
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		log.Printf("prometheusHandler: Unsupported url: %s", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		log.Printf("prometheusHandler: Unsupported method: %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var writer prometheusWriter
+	writePrometheusMetrics(&writer, currentSettings().MetricsLabelKeys, requestScope(r), requestRedactor(r))
+
+	var buffer bytes.Buffer
+	writer.WriteTo(&buffer)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
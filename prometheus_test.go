@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetricsLabelKeys(t *testing.T) {
+	keys, err := parseMetricsLabelKeys(" team, com.example.tier ,team,,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := []string{"team", "com.example.tier"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Got %#v, expected %#v", keys, expected)
+	}
+
+	if _, err := parseMetricsLabelKeys("app.name,app-name"); err == nil {
+		t.Errorf("Expected an error for keys that are both label_app_name")
+	}
+}
+
+func TestContainerMetricLabelsSkipsCollisions(t *testing.T) {
+	document := container{
+		"Id":     "0123456789abcdef",
+		"Name":   "/api",
+		"Config": map[string]interface{}{"Image": "nginx", "Labels": map[string]interface{}{"app.name": "a", "app-name": "b"}},
+	}
+	labels := containerMetricLabels(document, []string{"app.name", "app-name"})
+	expected := []string{"name", "api", "image", "nginx", "id", "0123456789ab", "label_app_name", "a"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Got %#v, expected %#v", labels, expected)
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 type sourceContainers []map[string]interface{}
@@ -107,34 +110,385 @@ func getContainer(queryer dockerQueryer, id string) (bool, container, error) {
 		return false, nil, err
 	}
 
+	// Older api versions have no State.Status, we fill it in so it can be filtered, sorted and selected on any version
+	if state, ok := container["State"].(map[string]interface{}); ok {
+		if _, exists := state["Status"]; !exists {
+			state["Status"] = containerStatus(container)
+		}
+	}
+
 	return true, container, nil
 }
 
-func watchForEvents(queryer dockerQueryer, outgoing chan<- event) {
+// watchForEvents sends events until the stream ends or stop is closed, connected is called once the daemon has accepted the request
+// The stream should not end, so we always return an error for the caller to retry on
+func watchForEvents(queryer dockerQueryer, outgoing chan<- event, connected func(), stop <-chan struct{}) error {
 	log.Println("watchForEvents: About to start watching")
 	eventsURL := "events"
 
 	resp, err := queryer(eventsURL)
 	if err != nil {
-		log.Fatalf("watchForEvents: execGet error: %s\n", err)
+		log.Printf("watchForEvents: execGet error: %s\n", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Fatalf("watchForEvents: Non 200 returned: %d", resp.StatusCode)
+		message := fmt.Sprintf("watchForEvents: Non 200 returned: %d", resp.StatusCode)
+		log.Println(message)
+		return fmt.Errorf(message)
 	}
+	connected()
+
+	// Closing the body ends the blocked decode
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-finished:
+		}
+	}()
 
-	var event event
 	decoder := json.NewDecoder(resp.Body)
 	for {
+		// A new event each time, decoding into an existing map would merge into an event we have already sent
+		var event event
 		if err := decoder.Decode(&event); err != nil {
 			if err == io.EOF {
-				break
+				err = fmt.Errorf("Event stream closed by the daemon")
 			}
-			// This will not terminate loop
+			// The decoder cannot recover from a bad stream so we reconnect
 			log.Printf("watchForEvents: Decode error: %s", err)
-		} else {
-			outgoing <- event
+			return err
 		}
+		select {
+		case outgoing <- event:
+		case <-stop:
+			return fmt.Errorf("Stopped")
+		}
+	}
+}
+
+// pingDaemon checks the daemon is reachable and responding
+func pingDaemon(queryer dockerQueryer) error {
+	resp, err := queryer("_ping")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Daemon ping returned: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func getRunningContainerIDs(queryer dockerQueryer) ([]string, error) {
+	containersURL := "/containers/json"
+
+	resp, err := queryer(containersURL)
+	if err != nil {
+		log.Printf("getRunningContainerIDs: queryer error: %s\n", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		message := fmt.Sprintf("getRunningContainerIDs: Non 200 response code: %d", resp.StatusCode)
+		log.Println(message)
+		return nil, fmt.Errorf(message)
+	}
+
+	var sourceContainers sourceContainers
+	if err := json.NewDecoder(resp.Body).Decode(&sourceContainers); err != nil {
+		log.Printf("getRunningContainerIDs: Decode source containers error: %s\n", err)
+		return nil, err
+	}
+
+	ids := make([]string, len(sourceContainers))
+	for index, sourceContainer := range sourceContainers {
+		ids[index] = sourceContainer["Id"].(string)
+	}
+
+	return ids, nil
+}
+
+func getContainerStats(queryer dockerQueryer, id string) (bool, *containerStats, error) {
+	// The stats endpoint streams for this API version, so we only read the first sample and then close
+	statsURL := fmt.Sprintf("containers/%s/stats", id)
+
+	resp, err := queryer(statsURL)
+	if err != nil {
+		log.Printf("getContainerStats: queryer error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// Good
+	case 404:
+		log.Printf("getContainerStats: Not found for id: %s\n", id)
+		return false, nil, nil
+	default:
+		message := fmt.Sprintf("getContainerStats: Unexpected response code for id: %s code: %d", id, resp.StatusCode)
+		log.Println(message)
+		return false, nil, fmt.Errorf(message)
+	}
+
+	var stats containerStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		log.Printf("getContainerStats: Decode error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+
+	return true, &stats, nil
+}
+
+func getContainerLogs(queryer dockerQueryer, id string, options *logOptions) (bool, io.ReadCloser, error) {
+	log.Printf("getContainerLogs: About to get for Id: %s\n", id)
+	query := url.Values{}
+	query.Set("stdout", strconv.FormatBool(options.Stdout))
+	query.Set("stderr", strconv.FormatBool(options.Stderr))
+	query.Set("timestamps", "1")
+	query.Set("tail", options.Tail)
+	if options.Follow {
+		query.Set("follow", "1")
+	}
+	// Older daemons ignore these, we filter on them as we read anyway
+	if !options.Since.IsZero() {
+		query.Set("since", strconv.FormatInt(options.Since.Unix(), 10))
+	}
+	if !options.Until.IsZero() {
+		query.Set("until", strconv.FormatInt(options.Until.Unix()+1, 10))
+	}
+	logsURL := fmt.Sprintf("containers/%s/logs?%s", id, query.Encode())
+
+	resp, err := queryer(logsURL)
+	if err != nil {
+		log.Printf("getContainerLogs: queryer error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// Good, caller closes the body
+		return true, resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		log.Printf("getContainerLogs: Not found for id: %s\n", id)
+		return false, nil, nil
+	default:
+		resp.Body.Close()
+		message := fmt.Sprintf("getContainerLogs: Unexpected response code for id: %s code: %d", id, resp.StatusCode)
+		log.Println(message)
+		return false, nil, fmt.Errorf(message)
+	}
+}
+
+func getContainerTop(queryer dockerQueryer, id, psArgs string) (bool, map[string]interface{}, error) {
+	log.Printf("getContainerTop: About to get for Id: %s\n", id)
+	topURL := fmt.Sprintf("containers/%s/top", id)
+	if psArgs != "" {
+		topURL += "?ps_args=" + url.QueryEscape(psArgs)
+	}
+
+	resp, err := queryer(topURL)
+	if err != nil {
+		log.Printf("getContainerTop: queryer error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// Good
+	case 404:
+		log.Printf("getContainerTop: Not found for id: %s\n", id)
+		return false, nil, nil
+	default:
+		// Older daemons return a 500 rather than a 409 for a container that is not running, so include the daemon's message
+		message := fmt.Sprintf("getContainerTop: Unexpected response code for id: %s code: %d message: %s", id, resp.StatusCode, readErrorMessage(resp.Body))
+		log.Println(message)
+		return false, nil, fmt.Errorf(message)
+	}
+
+	var top map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&top); err != nil {
+		log.Printf("getContainerTop: Decode error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+
+	return true, top, nil
+}
+
+// readErrorMessage reads the start of an error response body, the daemon returns plain text or a json message
+func readErrorMessage(body io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, 1024))
+
+	var errorResponse struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &errorResponse); err == nil && errorResponse.Message != "" {
+		return errorResponse.Message
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+type containerChange struct {
+	Path string
+	Kind int // 0 modified, 1 added, 2 deleted
+}
+
+func getContainerChanges(queryer dockerQueryer, id string) (bool, []containerChange, error) {
+	log.Printf("getContainerChanges: About to get for Id: %s\n", id)
+	changesURL := fmt.Sprintf("containers/%s/changes", id)
+
+	resp, err := queryer(changesURL)
+	if err != nil {
+		log.Printf("getContainerChanges: queryer error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// Good
+	case 404:
+		log.Printf("getContainerChanges: Not found for id: %s\n", id)
+		return false, nil, nil
+	default:
+		message := fmt.Sprintf("getContainerChanges: Unexpected response code for id: %s code: %d message: %s", id, resp.StatusCode, readErrorMessage(resp.Body))
+		log.Println(message)
+		return false, nil, fmt.Errorf(message)
+	}
+
+	// The daemon returns null rather than an empty list if there are no changes
+	var changes []containerChange
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		log.Printf("getContainerChanges: Decode error for id: %s error: %s\n", id, err)
+		return false, nil, err
+	}
+
+	return true, changes, nil
+}
+
+// getDaemonDocument gets one of the daemon level json documents, i.e. info or version, decoding into document
+func getDaemonDocument(queryer dockerQueryer, documentURL string, document interface{}) error {
+	log.Printf("getDaemonDocument: About to get %s\n", documentURL)
+
+	resp, err := queryer(documentURL)
+	if err != nil {
+		log.Printf("getDaemonDocument: queryer error for %s error: %s\n", documentURL, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		message := fmt.Sprintf("getDaemonDocument: Non 200 response code for %s code: %d message: %s", documentURL, resp.StatusCode, readErrorMessage(resp.Body))
+		log.Println(message)
+		return fmt.Errorf(message)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(document); err != nil {
+		log.Printf("getDaemonDocument: Decode error for %s error: %s\n", documentURL, err)
+		return err
+	}
+
+	return nil
+}
+
+// getDiskUsage uses system/df if the daemon supports it, otherwise falls back to the container and image lists which have no volume or build cache figures
+func getDiskUsage(systemQueryer, queryer dockerQueryer) (*diskUsage, error) {
+	var source sourceDiskUsage
+	if err := getDaemonDocument(systemQueryer, "system/df", &source); err == nil {
+		return newDiskUsage(&source, "system/df"), nil
+	}
+	log.Println("getDiskUsage: system/df failed, will fall back to the container and image lists")
+
+	source = sourceDiskUsage{}
+	if err := getDaemonDocument(queryer, "containers/json?all=1&size=1", &source.Containers); err != nil {
+		return nil, err
+	}
+	if err := getDaemonDocument(queryer, "images/json", &source.Images); err != nil {
+		return nil, err
+	}
+	// The image list at our api version has neither of these, so mark them as not calculated
+	for index := range source.Images {
+		source.Images[index].SharedSize = -1
+		source.Images[index].Containers = -1
+	}
+
+	return newDiskUsage(&source, "containers/json?size=1 and images/json"), nil
+}
+
+type containerCandidate struct {
+	ID   string `json:"Id"`
+	Name string
+}
+
+// resolveContainerRef resolves a full id, a container name or a unique id prefix to a full id, the same way the docker cli does
+// Not found gives an empty id with no candidates, an ambiguous prefix gives an empty id with the candidates
+// Containers outside the scope are treated as if they do not exist
+func resolveContainerRef(queryer dockerQueryer, ref string, scope *containerScope) (string, []containerCandidate, error) {
+	if fullContainerIDRegexp.MatchString(ref) && scope == nil {
+		return ref, nil, nil
+	}
+
+	containersURL := "/containers/json?all=1"
+
+	resp, err := queryer(containersURL)
+	if err != nil {
+		log.Printf("resolveContainerRef: queryer error for ref: %s error: %s\n", ref, err)
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		message := fmt.Sprintf("resolveContainerRef: Non 200 response code for ref: %s code: %d", ref, resp.StatusCode)
+		log.Println(message)
+		return "", nil, fmt.Errorf(message)
+	}
+
+	var sourceContainers []struct {
+		ID     string `json:"Id"`
+		Names  []string
+		Labels map[string]interface{}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sourceContainers); err != nil {
+		log.Printf("resolveContainerRef: Decode source containers error for ref: %s error: %s\n", ref, err)
+		return "", nil, err
+	}
+
+	// Names include links, i.e. /web and /proxy/web, the container's own name is the one without a second slash
+	var prefixMatches []containerCandidate
+	for _, sourceContainer := range sourceContainers {
+		if !scope.allowsLabels(sourceContainer.Labels) {
+			continue
+		}
+
+		name := ""
+		for _, candidateName := range sourceContainer.Names {
+			if strings.Count(candidateName, "/") == 1 {
+				name = strings.TrimPrefix(candidateName, "/")
+			}
+		}
+
+		if name == ref || sourceContainer.ID == ref {
+			return sourceContainer.ID, nil, nil
+		}
+		if strings.HasPrefix(sourceContainer.ID, ref) {
+			prefixMatches = append(prefixMatches, containerCandidate{ID: sourceContainer.ID, Name: name})
+		}
+	}
+
+	if len(prefixMatches) == 1 {
+		return prefixMatches[0].ID, nil, nil
+	}
+
+	return "", prefixMatches, nil
 }
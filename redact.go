@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "********"
+
+// redactor masks env values, label values and command line arguments whose names match the pattern
+// Masking is applied to copies, the state store keeps the documents as the daemon returned them
+type redactor struct {
+	Names *regexp.Regexp
+}
+
+func newRedactor(pattern string) (*redactor, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	names, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redactor{Names: names}, nil
+}
+
+// requestRedactor is nil if the caller's policies allow them to see unmasked values
+func requestRedactor(r *http.Request) *redactor {
+	return identityRedactor(currentSettings(), requestIdentity(r))
+}
+
+// identityRedactor is the redactor for the identity with the settings, for web sockets that apply the current settings to each event
+func identityRedactor(current *settings, id *identity) *redactor {
+	if current.Redactor == nil {
+		return nil
+	}
+	if id != nil && current.Policies != nil && current.Policies.Unredacted(id.Name) {
+		return nil
+	}
+
+	return current.Redactor
+}
+
+// Pattern is the names pattern, empty if redaction is disabled
+func (r *redactor) Pattern() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.Names.String()
+}
+
+// Container returns a copy of the inspect document with Config.Env, Config.Labels, Config.Cmd, Config.Entrypoint and Args masked
+func (r *redactor) Container(document container) container {
+	if r == nil || document == nil {
+		return document
+	}
+
+	result := make(container, len(document))
+	for key, value := range document {
+		result[key] = value
+	}
+	if args, ok := document["Args"].([]interface{}); ok {
+		result["Args"] = r.args(args)
+	}
+
+	config, ok := document["Config"].(map[string]interface{})
+	if !ok {
+		return result
+	}
+	redactedConfig := make(map[string]interface{}, len(config))
+	for key, value := range config {
+		redactedConfig[key] = value
+	}
+	if env, ok := config["Env"].([]interface{}); ok {
+		redactedEnv := make([]interface{}, len(env))
+		for index, item := range env {
+			redactedEnv[index] = item
+			if text, ok := item.(string); ok {
+				redactedEnv[index] = r.assignment(text)
+			}
+		}
+		redactedConfig["Env"] = redactedEnv
+	}
+	if labels, ok := config["Labels"].(map[string]interface{}); ok {
+		redactedConfig["Labels"] = r.attributes(labels)
+	}
+	for _, key := range []string{"Cmd", "Entrypoint"} {
+		switch typed := config[key].(type) {
+		case []interface{}:
+			redactedConfig[key] = r.args(typed)
+		case string:
+			// Older daemons can have a single string
+			redactedConfig[key] = r.commandLine(typed)
+		}
+	}
+	result["Config"] = redactedConfig
+
+	return result
+}
+
+func (r *redactor) Containers(documents containers) containers {
+	if r == nil {
+		return documents
+	}
+
+	result := make(containers, len(documents))
+	for index, document := range documents {
+		result[index] = r.Container(document)
+	}
+
+	return result
+}
+
+// Event masks the attributes of newer api events, which include the container's labels
+func (r *redactor) Event(document event) event {
+	if r == nil {
+		return document
+	}
+	actor, ok := document["Actor"].(map[string]interface{})
+	if !ok {
+		return document
+	}
+	attributes, ok := actor["Attributes"].(map[string]interface{})
+	if !ok {
+		return document
+	}
+
+	result := make(event, len(document))
+	for key, value := range document {
+		result[key] = value
+	}
+	redactedActor := make(map[string]interface{}, len(actor))
+	for key, value := range actor {
+		redactedActor[key] = value
+	}
+	redactedActor["Attributes"] = r.attributes(attributes)
+	result["Actor"] = redactedActor
+
+	return result
+}
+
+// Top returns a copy of a container's top with the command lines masked, the column is CMD or COMMAND depending on the ps_args
+func (r *redactor) Top(top map[string]interface{}) map[string]interface{} {
+	if r == nil || top == nil {
+		return top
+	}
+	titles, _ := top["Titles"].([]interface{})
+	processes, _ := top["Processes"].([]interface{})
+	column := -1
+	for index, title := range titles {
+		if title == "CMD" || title == "COMMAND" || title == "ARGS" {
+			column = index
+		}
+	}
+	if column < 0 {
+		return top
+	}
+
+	result := make(map[string]interface{}, len(top))
+	for key, value := range top {
+		result[key] = value
+	}
+	redactedProcesses := make([]interface{}, len(processes))
+	for index, process := range processes {
+		redactedProcesses[index] = process
+		fields, ok := process.([]interface{})
+		if !ok || column >= len(fields) {
+			continue
+		}
+		if text, ok := fields[column].(string); ok {
+			redactedFields := make([]interface{}, len(fields))
+			copy(redactedFields, fields)
+			redactedFields[column] = r.commandLine(text)
+			redactedProcesses[index] = redactedFields
+		}
+	}
+	result["Processes"] = redactedProcesses
+
+	return result
+}
+
+func (r *redactor) attributes(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		result[key] = value
+		if r.Names.MatchString(key) {
+			result[key] = redactedValue
+		}
+	}
+
+	return result
+}
+
+// assignment masks NAME=value if the name matches
+func (r *redactor) assignment(text string) string {
+	if index := strings.Index(text, "="); index > 0 && r.Names.MatchString(text[:index]) {
+		return text[:index+1] + redactedValue
+	}
+
+	return text
+}
+
+// args masks --name=value, the argument after --name, and NAME=value, if the name matches
+func (r *redactor) args(args []interface{}) []interface{} {
+	result := make([]interface{}, len(args))
+	copy(result, args)
+	for index := 0; index < len(args); index++ {
+		text, ok := args[index].(string)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(text, "-") {
+			result[index] = r.assignment(text)
+			continue
+		}
+
+		name := strings.TrimLeft(text, "-")
+		if strings.Contains(name, "=") {
+			result[index] = text[:len(text)-len(name)] + r.assignment(name)
+			continue
+		}
+		if name != "" && r.Names.MatchString(name) && index+1 < len(args) {
+			if next, ok := args[index+1].(string); ok && !strings.HasPrefix(next, "-") {
+				result[index+1] = redactedValue
+				index++
+			}
+		}
+	}
+
+	return result
+}
+
+// commandLine masks the arguments of a command line that is a single string, the arguments are split on white space
+func (r *redactor) commandLine(text string) string {
+	fields := strings.Fields(text)
+	args := make([]interface{}, len(fields))
+	for index, field := range fields {
+		args[index] = field
+	}
+	parts := make([]string, len(fields))
+	for index, arg := range r.args(args) {
+		parts[index] = arg.(string)
+	}
+
+	return strings.Join(parts, " ")
+}
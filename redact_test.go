@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedactorTop(t *testing.T) {
+	masker, err := newRedactor("(?i)password|secret|token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, title := range []string{"CMD", "COMMAND"} {
+		process := []interface{}{"root", "1", "app --token abc --password=hunter2 DB_SECRET=s3 --port 80"}
+		top := map[string]interface{}{
+			"Titles":    []interface{}{"UID", "PID", title},
+			"Processes": []interface{}{process, []interface{}{"root", "2"}},
+		}
+		expected := []interface{}{"root", "1", "app --token ******** --password=******** DB_SECRET=******** --port 80"}
+
+		redacted := masker.Top(top)
+		if processes := redacted["Processes"].([]interface{}); !reflect.DeepEqual(processes[0], expected) || len(processes[1].([]interface{})) != 2 {
+			t.Errorf("%s: got %#v, expected %#v", title, processes, expected)
+		}
+		if process[2] != "app --token abc --password=hunter2 DB_SECRET=s3 --port 80" {
+			t.Errorf("%s: the daemon's top was changed: %#v", title, process)
+		}
+	}
+
+	var disabled *redactor
+	top := map[string]interface{}{"Titles": []interface{}{"CMD"}, "Processes": []interface{}{[]interface{}{"app --token abc"}}}
+	if !reflect.DeepEqual(disabled.Top(top), top) {
+		t.Errorf("A nil redactor changed the top")
+	}
+}
+
+func TestRedactorArgs(t *testing.T) {
+	masker, err := newRedactor("(?i)password|secret|token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Args     []interface{}
+		Expected []interface{}
+	}{
+		{[]interface{}{"app", "--token", "abc", "--port", "80"}, []interface{}{"app", "--token", redactedValue, "--port", "80"}},
+		{[]interface{}{"app", "-password", "abc"}, []interface{}{"app", "-password", redactedValue}},
+		{[]interface{}{"app", "--password=abc", "--port=80"}, []interface{}{"app", "--password=" + redactedValue, "--port=80"}},
+		{[]interface{}{"DB_SECRET=abc", "HOME=/root", "app"}, []interface{}{"DB_SECRET=" + redactedValue, "HOME=/root", "app"}},
+		// A flag with no value, followed by another flag or nothing, leaves the next argument alone
+		{[]interface{}{"app", "--token", "--verbose"}, []interface{}{"app", "--token", "--verbose"}},
+		{[]interface{}{"app", "--token"}, []interface{}{"app", "--token"}},
+		// The value is not checked as a name
+		{[]interface{}{"app", "--token", "password", "run"}, []interface{}{"app", "--token", redactedValue, "run"}},
+		{[]interface{}{"app", "--", "password"}, []interface{}{"app", "--", "password"}},
+		{[]interface{}{"app", 1, "--token", 2}, []interface{}{"app", 1, "--token", 2}},
+		{nil, []interface{}{}},
+	}
+	for _, test := range tests {
+		if args := masker.args(test.Args); !reflect.DeepEqual(args, test.Expected) {
+			t.Errorf("%#v: got %#v, expected %#v", test.Args, args, test.Expected)
+		}
+	}
+}
+
+func TestRedactorContainer(t *testing.T) {
+	masker, err := newRedactor("(?i)password|secret|token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name     string
+		Document container
+		Expected container
+	}{
+		{
+			"Env",
+			container{"Config": map[string]interface{}{"Env": []interface{}{"DB_PASSWORD=hunter2", "PATH=/bin", "SECRET", 1}}},
+			container{"Config": map[string]interface{}{"Env": []interface{}{"DB_PASSWORD=" + redactedValue, "PATH=/bin", "SECRET", 1}}},
+		},
+		{
+			"Labels",
+			container{"Config": map[string]interface{}{"Labels": map[string]interface{}{"team": "payments", "db.password": "hunter2"}}},
+			container{"Config": map[string]interface{}{"Labels": map[string]interface{}{"team": "payments", "db.password": redactedValue}}},
+		},
+		{
+			"Cmd and Entrypoint arrays",
+			container{"Config": map[string]interface{}{"Entrypoint": []interface{}{"app", "--token", "abc"}, "Cmd": []interface{}{"--secret=s3", "run"}}},
+			container{"Config": map[string]interface{}{"Entrypoint": []interface{}{"app", "--token", redactedValue}, "Cmd": []interface{}{"--secret=" + redactedValue, "run"}}},
+		},
+		{
+			"Cmd and Entrypoint strings",
+			container{"Config": map[string]interface{}{"Entrypoint": "app --token abc", "Cmd": "TOKEN=abc run"}},
+			container{"Config": map[string]interface{}{"Entrypoint": "app --token " + redactedValue, "Cmd": "TOKEN=" + redactedValue + " run"}},
+		},
+		{
+			"Args",
+			container{"Path": "app", "Args": []interface{}{"--password", "hunter2", "--port", "80"}},
+			container{"Path": "app", "Args": []interface{}{"--password", redactedValue, "--port", "80"}},
+		},
+		{
+			"Other fields",
+			container{"Id": "web", "Name": "/web", "Config": map[string]interface{}{"Image": "app:1", "Cmd": nil}},
+			container{"Id": "web", "Name": "/web", "Config": map[string]interface{}{"Image": "app:1", "Cmd": nil}},
+		},
+		{"No config", container{"Id": "web"}, container{"Id": "web"}},
+		{"Nil", nil, nil},
+	}
+	for _, test := range tests {
+		if redacted := masker.Container(test.Document); !reflect.DeepEqual(redacted, test.Expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.Name, redacted, test.Expected)
+		}
+	}
+
+	var disabled *redactor
+	document := container{"Config": map[string]interface{}{"Env": []interface{}{"DB_PASSWORD=hunter2"}}}
+	if !reflect.DeepEqual(disabled.Container(document), document) {
+		t.Errorf("A nil redactor changed the container")
+	}
+}
+
+func TestRedactorEvent(t *testing.T) {
+	masker, err := newRedactor("(?i)password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name     string
+		Event    event
+		Expected event
+	}{
+		{
+			"Attributes",
+			event{"Action": "start", "Actor": map[string]interface{}{"ID": "db", "Attributes": map[string]interface{}{"name": "db", "db.password": "hunter2"}}},
+			event{"Action": "start", "Actor": map[string]interface{}{"ID": "db", "Attributes": map[string]interface{}{"name": "db", "db.password": redactedValue}}},
+		},
+		// Older api events have no actor
+		{"No actor", event{"status": "start", "id": "db"}, event{"status": "start", "id": "db"}},
+		{"No attributes", event{"Actor": map[string]interface{}{"ID": "db"}}, event{"Actor": map[string]interface{}{"ID": "db"}}},
+	}
+	for _, test := range tests {
+		if redacted := masker.Event(test.Event); !reflect.DeepEqual(redacted, test.Expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.Name, redacted, test.Expected)
+		}
+	}
+}
+
+func TestRedactorLeavesTheStoreAlone(t *testing.T) {
+	defer withTestStore()()
+	masker, err := newRedactor("(?i)password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &fakeDaemon{Containers: map[string]container{
+		"db": {
+			"Id":   "db",
+			"Name": "/db",
+			"Args": []interface{}{"--password", "hunter2"},
+			"Config": map[string]interface{}{
+				"Env":        []interface{}{"DB_PASSWORD=hunter2"},
+				"Labels":     map[string]interface{}{"db.password": "hunter2"},
+				"Cmd":        []interface{}{"--password=hunter2"},
+				"Entrypoint": "db --password hunter2",
+			},
+		},
+	}}
+	store.Apply(daemon.query, event{"Type": "container", "Action": "start", "id": "db"})
+
+	snapshot, _, _ := store.Snapshot()
+	before, _ := json.Marshal(snapshot)
+	masker.Containers(snapshot)
+	masker.Event(event{"Actor": map[string]interface{}{"ID": "db", "Attributes": snapshot[0]["Config"].(map[string]interface{})["Labels"]}})
+
+	snapshot, _, _ = store.Snapshot()
+	if after, _ := json.Marshal(snapshot); string(after) != string(before) {
+		t.Errorf("The store was changed: got %s, expected %s", after, before)
+	}
+}
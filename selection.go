@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+const composeProjectLabel = "com.docker.compose.project"
+
+// Label selectors are comma separated requirements which must all match, i.e. team=payments,env!=prod,tier
+type labelRequirement struct {
+	Key      string
+	Value    string
+	HasValue bool // If false we only require the label to exist (or not exist if Negate)
+	Negate   bool
+}
+
+type labelSelector []labelRequirement
+
+func parseLabelSelector(value string) (labelSelector, error) {
+	var selector labelSelector
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var requirement labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			pair := strings.SplitN(part, "!=", 2)
+			requirement = labelRequirement{Key: pair[0], Value: pair[1], HasValue: true, Negate: true}
+		case strings.Contains(part, "="):
+			pair := strings.SplitN(part, "=", 2)
+			requirement = labelRequirement{Key: pair[0], Value: pair[1], HasValue: true}
+		case strings.HasPrefix(part, "!"):
+			requirement = labelRequirement{Key: part[1:], Negate: true}
+		default:
+			requirement = labelRequirement{Key: part}
+		}
+
+		requirement.Key = strings.TrimSpace(requirement.Key)
+		requirement.Value = strings.TrimSpace(requirement.Value)
+		if requirement.Key == "" {
+			return nil, fmt.Errorf("Invalid label selector: %s", value)
+		}
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+func (s labelSelector) matches(labels map[string]interface{}) bool {
+	for _, requirement := range s {
+		value, exists := labels[requirement.Key]
+		matched := exists
+		if exists && requirement.HasValue {
+			matched = fmt.Sprint(value) == requirement.Value
+		}
+		if matched == requirement.Negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containerLabels(container container) map[string]interface{} {
+	config, _ := container["Config"].(map[string]interface{})
+	labels, _ := config["Labels"].(map[string]interface{})
+
+	return labels
+}
+
+func containerName(container container) string {
+	name, _ := container["Name"].(string)
+
+	return strings.TrimPrefix(name, "/")
+}
+
+func containerID(container container) string {
+	id, _ := container["Id"].(string)
+
+	return id
+}
+
+// containerSelection picks a set of containers by id, label selector and compose project
+// Ids can be anything resolveContainerRef accepts, labels and project are combined, so project=shop&label=tier=web is the shop project's web tier
+type containerSelection struct {
+	IDs      []string
+	Labels   labelSelector
+	Project  string
+	All      bool // Set when nothing was specified and the caller allows that to mean every container
+	MaxCount int
+	Scope    *containerScope // Containers outside the caller's scope are never selected
+}
+
+func parseContainerSelection(query url.Values, maxCount int, allowAll bool) (*containerSelection, error) {
+	selection := &containerSelection{
+		Project:  query.Get("project"),
+		MaxCount: maxCount,
+	}
+
+	for _, id := range strings.Split(query.Get("containers"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			selection.IDs = append(selection.IDs, id)
+		}
+	}
+
+	var err error
+	if selection.Labels, err = parseLabelSelector(query.Get("label")); err != nil {
+		return nil, err
+	}
+
+	if len(selection.IDs) == 0 && len(selection.Labels) == 0 && selection.Project == "" {
+		if !allowAll {
+			return nil, fmt.Errorf("At least one of containers, label or project is required")
+		}
+		selection.All = true
+	}
+
+	return selection, nil
+}
+
+// selectionError is returned for selections the caller got wrong, as opposed to daemon errors
+type selectionError struct {
+	Message string
+}
+
+func (e *selectionError) Error() string {
+	return e.Message
+}
+
+func (s *containerSelection) Select(queryer dockerQueryer) (containers, error) {
+	var selected containers
+	seen := make(map[string]bool)
+	add := func(container container) error {
+		id := containerID(container)
+		if seen[id] {
+			return nil
+		}
+		if len(selected) == s.MaxCount {
+			return &selectionError{fmt.Sprintf("Too many containers selected, the maximum is %d", s.MaxCount)}
+		}
+		seen[id] = true
+		selected = append(selected, container)
+		return nil
+	}
+
+	for _, ref := range s.IDs {
+		id, candidates, err := resolveContainerRef(queryer, ref, s.Scope)
+		if err != nil {
+			log.Printf("containerSelection.Select: Resolve container error for ref: %s error: %s\n", ref, err)
+			return nil, err
+		}
+		if id == "" && len(candidates) > 0 {
+			names := make([]string, len(candidates))
+			for index, candidate := range candidates {
+				names[index] = fmt.Sprintf("%s (%s)", candidate.Name, candidate.ID[:12])
+			}
+			return nil, &selectionError{fmt.Sprintf("Ambiguous container reference %s, matches %s", ref, strings.Join(names, ", "))}
+		}
+		if id == "" {
+			return nil, &selectionError{fmt.Sprintf("Container not found for ref: %s", ref)}
+		}
+
+		found, container, err := getContainer(queryer, id)
+		if err != nil {
+			log.Printf("containerSelection.Select: Get container error for id: %s error: %s\n", id, err)
+			return nil, err
+		}
+		if !found {
+			return nil, &selectionError{fmt.Sprintf("Container not found for id: %s", id)}
+		}
+		if err := add(container); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.Labels) == 0 && s.Project == "" && !s.All {
+		return selected, nil
+	}
+
+	selector := s.Labels
+	if s.Project != "" {
+		selector = append(labelSelector{{Key: composeProjectLabel, Value: s.Project, HasValue: true}}, selector...)
+	}
+
+	all, err := getContainers(queryer)
+	if err != nil {
+		log.Printf("containerSelection.Select: Get containers error: %s\n", err)
+		return nil, err
+	}
+	for _, container := range all {
+		if !selector.matches(containerLabels(container)) || !s.Scope.allows(container) {
+			continue
+		}
+		if err := add(container); err != nil {
+			return nil, err
+		}
+	}
+
+	return selected, nil
+}
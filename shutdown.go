@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Web socket close status for the server going away, see RFC 6455 section 7.4.1
+const websocketGoingAway = 1001
+
+var (
+	shutdownChannel chan struct{} // Closed when shutting down, long running handlers that are not web sockets should end
+	openSockets     *socketRegistry
+)
+
+func init() {
+	shutdownChannel = make(chan struct{})
+	openSockets = &socketRegistry{
+		Sockets: make(map[*websocket.Conn]bool),
+		Clients: make(map[string]int),
+	}
+}
+
+// shutdown stops accepting connections, closes the web sockets with going away, stops the event stream and waits up to the timeout for in flight requests
+func shutdown(timeout time.Duration, servers ...*http.Server) error {
+	close(shutdownChannel)
+	openSockets.CloseAll(websocketGoingAway)
+	eventDistr.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	for _, server := range servers {
+		if serverErr := server.Shutdown(ctx); serverErr != nil {
+			log.Printf("shutdown: Server shutdown error for %s, in flight requests may have been cut off: %s\n", server.Addr, serverErr)
+			err = serverErr
+		}
+	}
+
+	// The stats history and the audit log are the only state we keep, so they are all there is to flush
+	if metricsHist != nil {
+		if saveErr := metricsHist.Save(); saveErr != nil {
+			log.Printf("shutdown: Save stats history error: %s\n", saveErr)
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}
+	if audit != nil {
+		if closeErr := audit.Close(); closeErr != nil {
+			log.Printf("shutdown: Close audit log error: %s\n", closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+	}
+	log.Println("shutdown: Complete")
+
+	return err
+}
+
+// socketRegistry tracks the open web sockets, the http server's shutdown does not include hijacked connections so we close them ourselves
+// It also limits the number of sockets overall and per client, zero is unlimited
+type socketRegistry struct {
+	Mutex        sync.Mutex
+	Sockets      map[*websocket.Conn]bool
+	Closed       bool
+	Clients      map[string]int // Sockets reserved by client key
+	Reserved     int
+	MaxSockets   int
+	MaxPerClient int
+}
+
+// SetLimits changes the limits, sockets already open over a new limit are left open
+func (s *socketRegistry) SetLimits(maxSockets, maxPerClient int) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	s.MaxSockets, s.MaxPerClient = maxSockets, maxPerClient
+}
+
+// Reserve is called before the upgrade, it returns an error if the client or the app is at its limit
+func (s *socketRegistry) Reserve(key string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.MaxSockets > 0 && s.Reserved >= s.MaxSockets {
+		return fmt.Errorf("Too many web sockets, the maximum is %d", s.MaxSockets)
+	}
+	if s.MaxPerClient > 0 && s.Clients[key] >= s.MaxPerClient {
+		return fmt.Errorf("Too many web sockets for %s, the maximum is %d", key, s.MaxPerClient)
+	}
+	s.Reserved++
+	s.Clients[key]++
+
+	return nil
+}
+
+func (s *socketRegistry) Release(key string) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	s.Reserved--
+	if s.Clients[key]--; s.Clients[key] <= 0 {
+		delete(s.Clients, key)
+	}
+}
+
+// Add returns false if we are shutting down, the socket has been closed and the caller should return
+func (s *socketRegistry) Add(ws *websocket.Conn) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.Closed {
+		closeSocket(ws, websocketGoingAway)
+		return false
+	}
+	s.Sockets[ws] = true
+
+	return true
+}
+
+func (s *socketRegistry) Remove(ws *websocket.Conn) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	delete(s.Sockets, ws)
+}
+
+// CloseAll sends a close frame with the status to each socket and closes it, sockets added later are closed straight away
+func (s *socketRegistry) CloseAll(status int) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	log.Printf("socketRegistry.CloseAll: Closing %d web sockets with status %d\n", len(s.Sockets), status)
+	s.Closed = true
+	for ws := range s.Sockets {
+		closeSocket(ws, status)
+	}
+	s.Sockets = make(map[*websocket.Conn]bool)
+}
+
+// closeCodec sends a close frame with the status, the websocket package only sends normal closure (1000) when closing
+var closeCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		status := v.(int)
+		return []byte{byte(status >> 8), byte(status)}, websocket.CloseFrame, nil
+	},
+}
+
+func closeSocket(ws *websocket.Conn, status int) {
+	if err := closeCodec.Send(ws, status); err != nil {
+		log.Printf("closeSocket: Write close error for %s error: %s\n", ws.Request().RemoteAddr, err)
+	}
+	ws.Close()
+}
+
+// trackedWebsocket checks the origin and the socket limits before the upgrade, then registers the connection for the duration of the handler so it can be closed on shutdown
+func trackedWebsocket(handler func(ws *websocket.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkWebsocketOrigin(r); err != nil {
+			log.Printf("trackedWebsocket: Rejected %s from %s error: %s", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		key := clientKey(r)
+		if err := openSockets.Reserve(key); err != nil {
+			log.Printf("trackedWebsocket: Rejected %s from %s error: %s", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer openSockets.Release(key)
+
+		// The origin has been checked, the handshake only needs to record it
+		server := websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) (err error) {
+				config.Origin, err = websocket.Origin(config, r)
+				return err
+			},
+			Handler: func(ws *websocket.Conn) {
+				if !openSockets.Add(ws) {
+					return
+				}
+				defer openSockets.Remove(ws)
+
+				handler(ws)
+			},
+		}
+		server.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxStateChanges = 1000
+
+const (
+	changeAdded    = "ADDED"
+	changeModified = "MODIFIED"
+	changeDeleted  = "DELETED"
+)
+
+var store *stateStore
+
+func init() {
+	store = newStateStore()
+}
+
+// stateChange is a change to a container's inspect document caused by a docker event
+type stateChange struct {
+	ResourceVersion int64
+	Type            string
+	ID              string
+	Previous        container // nil if added
+	Current         container // nil if deleted
+}
+
+// stateStore keeps the containers as last seen and the recent changes, each applied docker event is a new generation
+// Generations start from the boot time in milliseconds so versions from before a restart are older than any we have
+// The boot id is part of the etag so clients cannot match an etag from before a restart
+type stateStore struct {
+	Mutex        sync.Mutex
+	BootID       string
+	Generation   int64
+	HistoryStart int64 // We have every change after this generation
+	Containers   map[string]container
+	Changes      []stateChange
+	Changed      chan struct{} // Closed and replaced on each applied event so watchers can wait for changes
+	LastSync     time.Time     // When we last listed the containers, zero if we never have
+}
+
+func newStateStore() *stateStore {
+	now := time.Now()
+	generation := now.UnixNano() / int64(time.Millisecond)
+
+	return &stateStore{
+		BootID:       strconv.FormatInt(now.UnixNano(), 36),
+		Generation:   generation,
+		HistoryStart: generation,
+		Containers:   make(map[string]container),
+		Changed:      make(chan struct{}),
+	}
+}
+
+// Resync lists the containers and records the differences from what we have as changes, this catches up on any events we missed
+func (s *stateStore) Resync(queryer dockerQueryer) error {
+	containers, err := getContainers(queryer)
+	if err != nil {
+		return err
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	current := make(map[string]container, len(containers))
+	for _, container := range containers {
+		id := containerID(container)
+		current[id] = container
+		previous, existed := s.Containers[id]
+		switch {
+		case !existed:
+			s.record(stateChange{Type: changeAdded, ID: id, Current: container})
+		case !reflect.DeepEqual(previous, container):
+			s.record(stateChange{Type: changeModified, ID: id, Previous: previous, Current: container})
+		}
+	}
+	for id, previous := range s.Containers {
+		if _, exists := current[id]; !exists {
+			s.record(stateChange{Type: changeDeleted, ID: id, Previous: previous})
+		}
+	}
+
+	s.Containers = current
+	s.LastSync = time.Now()
+	s.notify()
+
+	return nil
+}
+
+// record adds the change as a new generation, must be called with the lock held
+func (s *stateStore) record(change stateChange) {
+	s.Generation++
+	change.ResourceVersion = s.Generation
+	s.Changes = append(s.Changes, change)
+	if len(s.Changes) > maxStateChanges {
+		s.HistoryStart = s.Changes[0].ResourceVersion
+		s.Changes = append([]stateChange(nil), s.Changes[1:]...)
+	}
+}
+
+func (s *stateStore) LastSynced() time.Time {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.LastSync
+}
+
+// Apply records the event's change to the container, the daemon is queried for the container's current document
+// If the query fails the change is not recorded and the error is returned, the caller should resync so it is not missed
+func (s *stateStore) Apply(queryer dockerQueryer, event event) (int64, error) {
+	// We query outside of the lock, events are applied one at a time by the distributor
+	id := eventContainerID(event)
+	var current container
+	found := false
+	var err error
+	if id != "" {
+		if found, current, err = getContainer(queryer, id); err != nil {
+			log.Printf("stateStore.Apply: Get container error for id: %s error: %s\n", id, err)
+			id = ""
+		}
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	defer s.notify()
+
+	previous, existed := s.Containers[id]
+	change := stateChange{ID: id, Previous: previous, Current: current}
+	switch {
+	case id == "":
+		// Not a container event, or we could not get the container, it is still a new generation
+		s.Generation++
+		return s.Generation, err
+	case found && existed:
+		change.Type = changeModified
+	case found:
+		change.Type = changeAdded
+	case existed:
+		change.Type = changeDeleted
+	default:
+		// Removed before we saw it
+		s.Generation++
+		return s.Generation, nil
+	}
+
+	if found {
+		s.Containers[id] = current
+	} else {
+		delete(s.Containers, id)
+	}
+	s.record(change)
+
+	return s.Generation, nil
+}
+
+// notify wakes any watchers, must be called with the lock held
+func (s *stateStore) notify() {
+	close(s.Changed)
+	s.Changed = make(chan struct{})
+}
+
+func (s *stateStore) CurrentGeneration() int64 {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.Generation
+}
+
+// Snapshot returns the containers and the generation they are at, along with a channel that is closed on the next change
+func (s *stateStore) Snapshot() (containers, int64, <-chan struct{}) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	result := make(containers, 0, len(s.Containers))
+	for _, container := range s.Containers {
+		result = append(result, container)
+	}
+	sort.Slice(result, func(i, j int) bool { return containerName(result[i]) < containerName(result[j]) })
+
+	return result, s.Generation, s.Changed
+}
+
+// Labels returns the container's labels as last seen, found is false if we do not have the container
+func (s *stateStore) Labels(id string) (map[string]interface{}, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	container, found := s.Containers[id]
+
+	return containerLabels(container), found
+}
+
+// Name returns the container's name as last seen, found is false if we do not have the container
+func (s *stateStore) Name(id string) (string, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	container, found := s.Containers[id]
+
+	return containerName(container), found
+}
+
+// ChangesSince returns the changes after the version, the generation they go up to and a channel that is closed on the next change
+// ok is false if the version is no longer in the history, or is from before a restart, so the caller needs to list again
+func (s *stateStore) ChangesSince(version int64) (changes []stateChange, generation int64, changed <-chan struct{}, ok bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if version < s.HistoryStart || version > s.Generation {
+		return nil, s.Generation, s.Changed, false
+	}
+	for _, change := range s.Changes {
+		if change.ResourceVersion > version {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, s.Generation, s.Changed, true
+}
+
+// ETag is weak as the variant only identifies the request that rendered the generation, not the bytes
+func (s *stateStore) ETag(generation int64, variant string) string {
+	return fmt.Sprintf(`W/"%s-%d-%s"`, s.BootID, generation, variant)
+}
+
+// eventContainerID returns the container id for container events, newer api versions have a Type, older ones only have from on container events
+func eventContainerID(event event) string {
+	if eventType, ok := event["Type"].(string); ok && eventType != "container" {
+		return ""
+	}
+	if _, ok := event["Type"]; !ok {
+		if _, ok := event["from"]; !ok {
+			return ""
+		}
+	}
+
+	id, _ := event["id"].(string)
+
+	return id
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Only the fields we sample, see the docker remote api "Get container stats based on resource usage"
+type containerStats struct {
+	Read     time.Time `json:"read"`
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage  uint64   `json:"total_usage"`
+			PercpuUsage []uint64 `json:"percpu_usage"`
+		} `json:"cpu_usage"`
+		SystemCPUUsage uint64 `json:"system_cpu_usage"`
+		OnlineCPUs     int    `json:"online_cpus"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+		Limit uint64 `json:"limit"`
+	} `json:"memory_stats"`
+}
+
+type statsSampler struct {
+	Interval time.Duration
+	History  *metricsHistory
+	Previous map[string]*containerStats // Last sample per container, cpu usage is cumulative so we need the previous sample to get a percentage
+}
+
+func newStatsSampler(interval time.Duration, history *metricsHistory) *statsSampler {
+	return &statsSampler{
+		Interval: interval,
+		History:  history,
+		Previous: make(map[string]*containerStats),
+	}
+}
+
+func (s *statsSampler) Run(queryer dockerQueryer) {
+	log.Printf("statsSampler.Run: About to start sampling every %s\n", s.Interval)
+	lastSave := time.Now()
+	for {
+		s.sample(queryer)
+		s.History.Expire(time.Now())
+
+		if time.Since(lastSave) >= time.Minute {
+			s.History.Save()
+			lastSave = time.Now()
+		}
+
+		time.Sleep(s.Interval)
+	}
+}
+
+func (s *statsSampler) sample(queryer dockerQueryer) {
+	ids, err := getRunningContainerIDs(queryer)
+	if err != nil {
+		log.Printf("statsSampler.sample: Get running container ids error: %s\n", err)
+		return
+	}
+
+	// Each stats request can take a second or so on the daemon side, so sample concurrently
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	current := make(map[string]*containerStats)
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			found, stats, err := getContainerStats(queryer, id)
+			if !found || err != nil {
+				return
+			}
+
+			mutex.Lock()
+			current[id] = stats
+			mutex.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for id, stats := range current {
+		sampleTime := stats.Read
+		if sampleTime.IsZero() {
+			sampleTime = now
+		}
+
+		s.History.Add(id, metricsPoint{
+			Time:        sampleTime,
+			CPUPercent:  cpuPercent(s.Previous[id], stats),
+			MemoryUsage: stats.MemoryStats.Usage,
+			MemoryLimit: stats.MemoryStats.Limit,
+		})
+	}
+
+	// Containers that are no longer running are dropped, so a restarted container does not get a bogus cpu delta
+	s.Previous = current
+}
+
+func cpuPercent(previous, current *containerStats) float64 {
+	if previous == nil {
+		return 0
+	}
+
+	cpuDelta := float64(current.CPUStats.CPUUsage.TotalUsage) - float64(previous.CPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(current.CPUStats.SystemCPUUsage) - float64(previous.CPUStats.SystemCPUUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	cpus := current.CPUStats.OnlineCPUs
+	if cpus == 0 {
+		cpus = len(current.CPUStats.CPUUsage.PercpuUsage)
+	}
+	if cpus == 0 {
+		cpus = 1
+	}
+
+	return cpuDelta / systemDelta * float64(cpus) * 100
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tlsReloadInterval = 10 * time.Second
+
+// tlsFiles loads the certificate, key and optional client CA, reloading them when they change so certificates can be renewed without a restart
+type tlsFiles struct {
+	Mutex        sync.Mutex
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // Optional, if set clients must present a certificate signed by one of these CAs
+	ModTimes     map[string]time.Time
+	Config       *tls.Config
+}
+
+func newTLSFiles(certFile, keyFile, clientCAFile string) (*tlsFiles, error) {
+	files := &tlsFiles{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+	}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ServerConfig is used by the http server, each handshake gets the config from the most recent load
+func (t *tlsFiles) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.Mutex.Lock()
+			defer t.Mutex.Unlock()
+
+			return t.Config, nil
+		},
+	}
+}
+
+// Run checks the files' modification times, a failed reload keeps the config we have
+func (t *tlsFiles) Run() {
+	for {
+		time.Sleep(tlsReloadInterval)
+
+		modTimes, err := t.modTimes()
+		if err != nil {
+			log.Printf("tlsFiles.Run: Stat error: %s\n", err)
+			continue
+		}
+		t.Mutex.Lock()
+		changed := false
+		for file, modTime := range modTimes {
+			if !modTime.Equal(t.ModTimes[file]) {
+				changed = true
+			}
+		}
+		t.Mutex.Unlock()
+		if !changed {
+			continue
+		}
+
+		if err := t.load(); err != nil {
+			log.Printf("tlsFiles.Run: Reload error, will continue with the previous certificate: %s\n", err)
+			continue
+		}
+		log.Printf("tlsFiles.Run: Reloaded %s\n", t.CertFile)
+	}
+}
+
+func (t *tlsFiles) modTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+func (t *tlsFiles) load() error {
+	// Mod times are taken first, so a change while we are loading is picked up next time
+	modTimes, err := t.modTimes()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Load certificate error: %s", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+
+	if t.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Read client CA error: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates found in client CA file: %s", t.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.ModTimes = modTimes
+	t.Config = config
+
+	return nil
+}
+
+// httpsRedirectHandler sends plain http requests to the same url on the https port
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if hostOnly, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostOnly
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		url := *r.URL
+		url.Scheme = "https"
+		url.Host = host
+
+		// 308 keeps the method and body, browsers only expect 301 for navigation
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, url.String(), status)
+	})
+}